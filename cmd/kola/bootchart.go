@@ -47,18 +47,23 @@ func runBootchart(cmd *cobra.Command, args []string) {
 		os.Exit(2)
 	}
 
-	var (
-		cluster platform.Cluster
-		err     error
-	)
-	if kolaPlatform == "qemu" {
+	pltfrm, err := singlePlatform()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+
+	var cluster platform.Cluster
+	if pltfrm == "qemu" {
 		cluster, err = platform.NewQemuCluster(kola.QEMUOptions)
-	} else if kolaPlatform == "gce" {
+	} else if pltfrm == "nspawn" {
+		cluster, err = platform.NewNSpawnCluster(kola.NSpawnOptions)
+	} else if pltfrm == "gce" {
 		cluster, err = platform.NewGCECluster(kola.GCEOptions)
-	} else if kolaPlatform == "aws" {
+	} else if pltfrm == "aws" {
 		cluster, err = platform.NewAWSCluster(kola.AWSOptions)
 	} else {
-		fmt.Fprintf(os.Stderr, "Invalid platform: %v", kolaPlatform)
+		fmt.Fprintf(os.Stderr, "Invalid platform: %v", pltfrm)
 	}
 
 	if err != nil {
@@ -67,7 +72,7 @@ func runBootchart(cmd *cobra.Command, args []string) {
 	}
 	defer cluster.Destroy()
 
-	m, err := cluster.NewMachine("")
+	m, err := cluster.NewMachine(nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Machine failed: %v\n", err)
 		os.Exit(1)
@@ -75,12 +75,12 @@ func runEtcdUpgrade(cmd *cobra.Command, args []string) {
 
 coreos:
   etcd2:
-    name: $name
-    discovery: $discovery
-    advertise-client-urls: http://$private_ipv4:2379
-    initial-advertise-peer-urls: http://$private_ipv4:2380
+    name: {{.Name}}
+    discovery: {{.Discovery}}
+    advertise-client-urls: http://{{.PrivateIPv4}}:2379
+    initial-advertise-peer-urls: http://{{.PrivateIPv4}}:2380
     listen-client-urls: http://0.0.0.0:2379,http://0.0.0.0:4001
-    listen-peer-urls: http://$private_ipv4:2380,http://$private_ipv4:7001`,
+    listen-peer-urls: http://{{.PrivateIPv4}}:2380,http://{{.PrivateIPv4}}:7001`,
 	}
 
 	kola.RegisterTestOption("EtcdUpgradeVersion", EtcdUpgradeVersion)
@@ -15,8 +15,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/spf13/cobra"
 	"github.com/coreos/mantle/cli"
@@ -33,8 +37,11 @@ var (
 	cmdRun = &cobra.Command{
 		Use:   "run [glob pattern]",
 		Short: "Run run kola tests by category",
-		Long:  "run all kola tests (default) or related groups",
-		Run:   runRun,
+		Long: `run all kola tests (default) or related groups
+
+Tests may be run on several platforms at once by passing a comma
+separated list to --platform, for example --platform=qemu,gce,aws.`,
+		Run: runRun,
 	}
 
 	cmdList = &cobra.Command{
@@ -44,7 +51,15 @@ var (
 	}
 )
 
+var (
+	listJSON bool
+	listLong bool
+)
+
 func init() {
+	cmdList.Flags().BoolVar(&listJSON, "json", false, "print test details as JSON")
+	cmdList.Flags().BoolVarP(&listLong, "long", "l", false, "print a table of test details")
+
 	root.AddCommand(cmdRun)
 	root.AddCommand(cmdList)
 }
@@ -65,15 +80,92 @@ func runRun(cmd *cobra.Command, args []string) {
 		pattern = "*" // run all tests by default
 	}
 
-	err := kola.RunTests(pattern, kolaPlatform)
+	for p, n := range platformParallel {
+		kola.PlatformParallelism[p] = *n
+	}
+
+	pltfrms, err := parsePlatforms()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+
+	err = kola.RunTests(pattern, pltfrms)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
 }
 
+// testInfo describes a registered test for kola list.
+type testInfo struct {
+	Name        string   `json:"name"`
+	ClusterSize int      `json:"cluster_size"`
+	Platforms   []string `json:"platforms,omitempty"` // empty means all
+	Tags        []string `json:"tags,omitempty"`
+	Requires    []string `json:"requires,omitempty"`
+	NativeFuncs []string `json:"native_funcs,omitempty"`
+	CloudConfig bool     `json:"cloud_config"`
+}
+
+func newTestInfo(t *kola.Test) testInfo {
+	info := testInfo{
+		Name:        t.Name,
+		ClusterSize: t.ClusterSize,
+		Platforms:   t.Platforms,
+		Tags:        t.Tags,
+		Requires:    t.Requires,
+		CloudConfig: t.CloudConfig != "",
+	}
+	for name := range t.NativeFuncs {
+		info.NativeFuncs = append(info.NativeFuncs, name)
+	}
+	sort.Strings(info.NativeFuncs)
+	return info
+}
+
+func listOrDash(l []string) string {
+	if len(l) == 0 {
+		return "-"
+	}
+	return strings.Join(l, ",")
+}
+
 func runList(cmd *cobra.Command, args []string) {
-	for tname, _ := range kola.Tests {
-		fmt.Println(tname)
+	var names []string
+	for tname := range kola.Tests {
+		names = append(names, tname)
+	}
+	sort.Strings(names)
+
+	var tests []testInfo
+	for _, tname := range names {
+		tests = append(tests, newTestInfo(kola.Tests[tname]))
+	}
+
+	switch {
+	case listJSON:
+		b, err := json.MarshalIndent(tests, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s\n", b)
+	case listLong:
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSIZE\tPLATFORMS\tTAGS\tREQUIRES\tCLOUD-CONFIG\tNATIVE FUNCTIONS")
+		for _, t := range tests {
+			platforms := "all"
+			if len(t.Platforms) > 0 {
+				platforms = strings.Join(t.Platforms, ",")
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%t\t%s\n", t.Name, t.ClusterSize,
+				platforms, listOrDash(t.Tags), listOrDash(t.Requires), t.CloudConfig, listOrDash(t.NativeFuncs))
+		}
+		w.Flush()
+	default:
+		for _, t := range tests {
+			fmt.Println(t.Name)
+		}
 	}
 }
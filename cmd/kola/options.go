@@ -15,12 +15,20 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/coreos/mantle/kola"
 	"github.com/coreos/mantle/sdk"
 )
 
 var (
-	kolaPlatform string
+	kolaPlatform  string
+	kolaPlatforms = []string{"qemu", "nspawn", "gce", "aws"}
+
+	// per-platform overrides of --parallel, keyed by platform name
+	platformParallel = make(map[string]*int)
 )
 
 func init() {
@@ -28,10 +36,31 @@ func init() {
 	bv := root.PersistentFlags().BoolVar
 
 	// general options
-	sv(&kolaPlatform, "platform", "qemu", "VM platform: qemu, gce, aws")
-	root.PersistentFlags().IntVar(&kola.TestParallelism, "parallel", 1, "number of tests to run in parallel")
+	sv(&kolaPlatform, "platform", "qemu", "VM platform: qemu, nspawn, gce, aws or a comma separated list to run tests on several")
+	root.PersistentFlags().IntVar(&kola.TestParallelism, "parallel", 1, "number of tests to run in parallel on each platform")
+	for _, p := range kolaPlatforms {
+		platformParallel[p] = root.PersistentFlags().Int(p+"-parallel", 0, "number of tests to run in parallel on "+p+", overrides --parallel")
+	}
+	sv(&kola.IncludeTags, "tags", "", "only run tests matching this tag expression, e.g. etcd+!slow,network")
+	sv(&kola.ExcludeTags, "exclude-tags", "", "skip tests matching this tag expression")
+	root.PersistentFlags().IntVar(&kola.TestRetries, "retry", 0, "number of times to rerun failed tests, tests passing on retry are reported as flaky")
+	root.PersistentFlags().DurationVar(&kola.DefaultTimeout, "timeout", 30*time.Minute, "default time limit for each test, 0 to disable")
+	sv(&kola.OutputDir, "output-dir", "_kola_temp", "directory to save logs and other artifacts from failed tests in, empty to disable")
+	sv(&kola.JUnitReport, "junit-report", "", "write a JUnit XML report of test results to this path")
+	sv(&kola.JSONReport, "json-report", "", "write a JSON file of test results to this path")
 
 	sv(&kola.QEMUOptions.DiskImage, "qemu-image", sdk.BuildRoot()+"/images/amd64-usr/latest/coreos_production_image.bin", "path to CoreOS disk image")
+	root.PersistentFlags().IntVar(&kola.QEMUOptions.Memory, "qemu-memory", 1024, "MiB of RAM for each qemu machine")
+	root.PersistentFlags().IntVar(&kola.QEMUOptions.CPUs, "qemu-cpus", 2, "number of CPUs for each qemu machine")
+	root.PersistentFlags().StringSliceVar(&kola.QEMUOptions.ExtraDisks, "qemu-disks", nil, "sizes of additional blank disks for each qemu machine, e.g. 1G,10G")
+	root.PersistentFlags().StringSliceVar(&kola.QEMUOptions.Networks, "qemu-networks", []string{"br0"}, "bridges to attach each qemu machine's network interfaces to, from br0, br1 and br2")
+	sv(&kola.QEMUOptions.Arch, "qemu-arch", "amd64", "architecture of the qemu image, amd64 or arm64")
+	sv(&kola.QEMUOptions.Firmware, "qemu-firmware", "", "firmware qemu machines boot with, bios or uefi (default bios, uefi on arm64)")
+	sv(&kola.QEMUOptions.OVMFCode, "qemu-ovmf-code", "", "OVMF firmware image for booting qemu machines with uefi (default /usr/share/OVMF/OVMF_CODE.fd, or AAVMF's on arm64)")
+	sv(&kola.QEMUOptions.OVMFVars, "qemu-ovmf-vars", "", "OVMF variable store copied for each qemu machine booting with uefi (default /usr/share/OVMF/OVMF_VARS.fd, or AAVMF's on arm64)")
+
+	// nspawn specific options
+	sv(&kola.NSpawnOptions.UsrTree, "nspawn-usr", "", "path to the /usr tree of a CoreOS image, e.g. its mounted USR-A partition")
 
 	// gce specific options
 	sv(&kola.GCEOptions.Image, "gce-image", "latest", "GCE image")
@@ -50,3 +79,47 @@ func init() {
 	sv(&kola.AWSOptions.InstanceType, "aws-type", "t1.micro", "AWS instance type")
 	sv(&kola.AWSOptions.SecurityGroup, "aws-sg", "kola", "AWS security group name")
 }
+
+// parsePlatforms returns the platforms listed by --platform, ignoring
+// whitespace, empty entries and duplicates.
+func parsePlatforms() ([]string, error) {
+	var pltfrms []string
+	seen := make(map[string]bool)
+	for _, p := range strings.Split(kolaPlatform, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" || seen[p] {
+			continue
+		}
+		if !validPlatform(p) {
+			return nil, fmt.Errorf("invalid platform %q, expected one of %s", p, strings.Join(kolaPlatforms, ", "))
+		}
+		seen[p] = true
+		pltfrms = append(pltfrms, p)
+	}
+	if len(pltfrms) == 0 {
+		return nil, fmt.Errorf("no platform given")
+	}
+	return pltfrms, nil
+}
+
+// singlePlatform returns the platform given by --platform for commands
+// that only support one.
+func singlePlatform() (string, error) {
+	pltfrms, err := parsePlatforms()
+	if err != nil {
+		return "", err
+	}
+	if len(pltfrms) > 1 {
+		return "", fmt.Errorf("only one platform is supported, got %s", strings.Join(pltfrms, ", "))
+	}
+	return pltfrms[0], nil
+}
+
+func validPlatform(p string) bool {
+	for _, known := range kolaPlatforms {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
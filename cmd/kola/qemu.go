@@ -52,7 +52,7 @@ func runQemu(cmd *cobra.Command, args []string) {
 	}
 	defer cluster.Destroy()
 
-	m, err := cluster.NewMachine("")
+	m, err := cluster.NewMachine(nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Machine failed: %v\n", err)
 		os.Exit(1)
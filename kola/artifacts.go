@@ -0,0 +1,101 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kola
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coreos/mantle/platform"
+)
+
+// commands run on each machine of a failed test, saved to the named files
+var artifactCommands = []struct {
+	file string
+	cmd  string
+}{
+	{"journal.txt", "journalctl --no-pager --output=short-precise"},
+	{"failed-units.txt", "systemctl --failed --no-pager --full"},
+	{"dmesg.txt", "sudo dmesg"},
+}
+
+// testOutputDir returns the directory artifacts from the current
+// attempt at running r.Test are written to, a separate one for each
+// attempt: <platform>/<test>/attempt1, attempt2 and so on.
+func testOutputDir(r *Result) string {
+	attempt := fmt.Sprintf("attempt%d", len(r.Attempts)+1)
+	return filepath.Join(OutputDir, r.Platform, r.Test.Name, attempt)
+}
+
+// artifactTimeout limits each command run to collect artifacts, so a
+// hung machine can't stop the cluster from being destroyed.
+const artifactTimeout = time.Minute
+
+// collectArtifacts saves debugging information from m to dir and
+// returns the paths of the files written. Commands are only run on the
+// machine if runCommands is set, the user data and console are saved
+// regardless. Errors are logged rather than returned so one
+// unreachable machine doesn't prevent collecting from the others.
+func collectArtifacts(m platform.Machine, dir string, runCommands bool) []string {
+	var paths []string
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		plog.Errorf("collecting artifacts: %v", err)
+		return paths
+	}
+
+	save := func(file string, data []byte) {
+		path := filepath.Join(dir, file)
+		if err := ioutil.WriteFile(path, data, 0666); err != nil {
+			plog.Errorf("collecting artifacts: %v", err)
+			return
+		}
+		paths = append(paths, path)
+	}
+
+	if runCommands {
+		for _, ac := range artifactCommands {
+			res, err := m.Run(ac.cmd, &platform.RunOptions{Timeout: artifactTimeout})
+			if err != nil {
+				plog.Errorf("collecting artifacts: %v", err)
+				continue
+			}
+			if !res.Success() {
+				plog.Errorf("collecting artifacts: %q on %s exited with status %d: %s",
+					ac.cmd, m.ID(), res.ExitStatus, bytes.TrimSpace(res.Stderr))
+			}
+			if len(res.Stdout) > 0 {
+				save(ac.file, res.Stdout)
+			}
+		}
+	}
+
+	if ud := m.UserData(); ud != "" {
+		save("user-data", []byte(ud))
+	}
+
+	console, err := m.ConsoleOutput()
+	if err != nil {
+		plog.Infof("collecting artifacts: console of %s: %v", m.ID(), err)
+	} else if console != "" {
+		save("console.txt", []byte(console))
+	}
+
+	return paths
+}
@@ -14,13 +14,17 @@
 
 package kola
 
-import "github.com/coreos/mantle/kola/tests/coretest"
+import (
+	"github.com/coreos/mantle/kola/tests/coretest"
+	"github.com/coreos/mantle/platform"
+)
 
 func init() {
 	Register(&Test{
 		Name:        "coretestsLocal",
 		Run:         coretest.LocalTests,
 		ClusterSize: 1,
+		Tags:        []string{"coretest"},
 		NativeFuncs: map[string]func() error{
 			"CloudConfig":      coretest.TestCloudinitCloudConfig,
 			"Script":           coretest.TestCloudinitScript,
@@ -38,6 +42,7 @@ func init() {
 		Name:        "coretestsCluster",
 		Run:         coretest.ClusterTests,
 		ClusterSize: 3,
+		Tags:        []string{"coretest", "etcd", "fleet"},
 		NativeFuncs: map[string]func() error{
 			"EtcdUpdateValue":    coretest.TestEtcdUpdateValue,
 			"FleetctlRunService": coretest.TestFleetctlRunService,
@@ -46,12 +51,12 @@ func init() {
 
 coreos:
   etcd2:
-    name: $name
-    discovery: $discovery
-    advertise-client-urls: http://$private_ipv4:2379
-    initial-advertise-peer-urls: http://$private_ipv4:2380
+    name: {{.Name}}
+    discovery: {{.Discovery}}
+    advertise-client-urls: http://{{.PrivateIPv4}}:2379
+    initial-advertise-peer-urls: http://{{.PrivateIPv4}}:2380
     listen-client-urls: http://0.0.0.0:2379,http://0.0.0.0:4001
-    listen-peer-urls: http://$private_ipv4:2380,http://$private_ipv4:7001
+    listen-peer-urls: http://{{.PrivateIPv4}}:2380,http://{{.PrivateIPv4}}:7001
   fleet:
     etcd-request-timeout: 15 
   units:
@@ -66,7 +71,8 @@ coreos:
 		Name:        "coretestsInternetLocal",
 		Run:         coretest.InternetTests,
 		ClusterSize: 1,
-		Platforms:   []string{"gce", "aws"},
+		Tags:        []string{"coretest", "docker"},
+		Requires:    []string{platform.CapInternet},
 		NativeFuncs: map[string]func() error{
 			"UpdateEngine": coretest.TestUpdateEngine,
 			"DockerPing":   coretest.TestDockerPing,
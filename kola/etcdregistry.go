@@ -14,23 +14,27 @@
 
 package kola
 
-import "github.com/coreos/mantle/kola/tests/etcd"
+import (
+	"github.com/coreos/mantle/kola/tests/etcd"
+	"github.com/coreos/mantle/platform"
+)
 
 //register new tests here
-// "$name" and "$discovery" are substituted in the cloud config during cluster creation
+// cloud configs are user data templates, see platform.RenderUserData
 func init() {
 	// test etcd discovery with 0.4.7
 	Register(&Test{
 		Run:         etcd.DiscoveryV1,
 		ClusterSize: 3,
 		Name:        "Etcd1Discovery",
+		Tags:        []string{"etcd"},
 		CloudConfig: `#cloud-config
 coreos:
   etcd:
-    name: $name
-    discovery: $discovery
-    addr: $private_ipv4:2379
-    peer-addr: $private_ipv4:2380`,
+    name: {{.Name}}
+    discovery: {{.Discovery}}
+    addr: {{.PrivateIPv4}}:2379
+    peer-addr: {{.PrivateIPv4}}:2380`,
 	})
 
 	// test etcd discovery with 2.0 with new cloud config
@@ -38,15 +42,35 @@ coreos:
 		Run:         etcd.DiscoveryV2,
 		ClusterSize: 3,
 		Name:        "Etcd2Discovery",
+		Tags:        []string{"etcd"},
 		CloudConfig: `#cloud-config
 
 coreos:
   etcd2:
-    name: $name
-    discovery: $discovery
-    advertise-client-urls: http://$private_ipv4:2379
-    initial-advertise-peer-urls: http://$private_ipv4:2380
+    name: {{.Name}}
+    discovery: {{.Discovery}}
+    advertise-client-urls: http://{{.PrivateIPv4}}:2379
+    initial-advertise-peer-urls: http://{{.PrivateIPv4}}:2380
     listen-client-urls: http://0.0.0.0:2379,http://0.0.0.0:4001
-    listen-peer-urls: http://$private_ipv4:2380,http://$private_ipv4:7001`,
+    listen-peer-urls: http://{{.PrivateIPv4}}:2380,http://{{.PrivateIPv4}}:7001`,
+	})
+
+	// test etcd quorum behavior with a member partitioned away
+	Register(&Test{
+		Run:         etcd.Partition,
+		ClusterSize: 3,
+		Name:        "Etcd2Partition",
+		Tags:        []string{"etcd", "network"},
+		Requires:    []string{platform.CapNetFaults},
+		CloudConfig: `#cloud-config
+
+coreos:
+  etcd2:
+    name: {{.Name}}
+    discovery: {{.Discovery}}
+    advertise-client-urls: http://{{.PrivateIPv4}}:2379
+    initial-advertise-peer-urls: http://{{.PrivateIPv4}}:2380
+    listen-client-urls: http://0.0.0.0:2379,http://0.0.0.0:4001
+    listen-peer-urls: http://{{.PrivateIPv4}}:2380,http://{{.PrivateIPv4}}:7001`,
 	})
 }
@@ -17,11 +17,12 @@ package kola
 import "github.com/coreos/mantle/kola/tests/fleet"
 
 //register new tests here
-// "$name" and "$discovery" are substituted in the cloud config during cluster creation
+// cloud configs are user data templates, see platform.RenderUserData
 func init() {
 	Register(&Test{
 		Run:         fleet.Proxy,
 		ClusterSize: 0,
 		Name:        "FleetProxy",
+		Tags:        []string{"fleet"},
 	})
 }
@@ -18,24 +18,51 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/pkg/capnslog"
 	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/sdk"
 )
 
 var (
 	plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "kola")
 
-	QEMUOptions platform.QEMUOptions
-	GCEOptions  platform.GCEOptions
-	AWSOptions  platform.AWSOptions
+	QEMUOptions   platform.QEMUOptions
+	NSpawnOptions platform.NSpawnOptions
+	GCEOptions    platform.GCEOptions
+	AWSOptions    platform.AWSOptions
 
 	TestParallelism int
 
+	// PlatformParallelism overrides TestParallelism for individual
+	// platforms when running tests on several at once.
+	PlatformParallelism = make(map[string]int)
+
+	// TestRetries is the number of times a failed test is rerun on a
+	// fresh cluster. Tests that pass on a retry are reported as flaky.
+	TestRetries int
+
+	// IncludeTags and ExcludeTags are TagExprs limiting the tests
+	// run. An empty IncludeTags selects all tests.
+	IncludeTags string
+	ExcludeTags string
+
+	// DefaultTimeout applies to tests that don't set their own
+	// Timeout. Zero or less disables it.
+	DefaultTimeout time.Duration
+
+	// OutputDir is where artifacts from failed tests are saved,
+	// nothing is collected if it is empty.
+	OutputDir string
+
+	JUnitReport string // path to write a JUnit XML report to, if set
+	JSONReport  string // path to write a JSON results file to, if set
+
 	testOptions = make(map[string]string, 0)
 )
 
@@ -55,13 +82,37 @@ func RegisterTestOption(name, option string) {
 // glue until kola does introspection.
 type NativeRunner func(funcName string, m platform.Machine) error
 
+// Test is a registered kola test. A test may run on several platforms
+// at once so its Run function must not modify any state shared between
+// runs, such as package variables.
 type Test struct {
 	Name        string // should be uppercase and unique
 	Run         func(platform.TestCluster) error
 	NativeFuncs map[string]func() error
 	CloudConfig string
 	ClusterSize int
-	Platforms   []string // whitelist of platforms to run test against -- defaults to all
+	Platforms   []string      // whitelist of platforms to run test against -- defaults to all
+	Tags        []string      // arbitrary labels to select tests by, see TagExpr
+	Requires    []string      // platform capabilities needed, see platform.Capabilities
+	Timeout     time.Duration // overrides DefaultTimeout if set
+
+	// Machine resources, overriding the platform options if set.
+	// Only supported by qemu.
+	Memory     int      // MiB of RAM
+	CPUs       int      // virtual CPUs
+	ExtraDisks []string // sizes of additional blank disks, e.g. "10G"
+	Networks   []string // bridge for each network interface, see platform.QEMUOptions
+	Firmware   string   // "bios" or "uefi", see platform.QEMUOptions
+}
+
+// TimeoutError is returned for tests that did not finish in time.
+type TimeoutError struct {
+	Timeout time.Duration
+	Stacks  []byte // goroutine stacks when the test timed out
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("test timed out after %v", e.Timeout)
 }
 
 // maps names to tests
@@ -77,32 +128,76 @@ func Register(t *Test) {
 }
 
 type Result struct {
-	Test     *Test
+	Test       *Test
+	Platform   string
+	Result     error
+	Duration   time.Duration
+	MachineIDs []string  // every machine created while running the test
+	Artifacts  []string  // files collected from the test's machines
+	Attempts   []Attempt // one per try, the last matches Result
+
+	// Subtests run by the last attempt, see platform.TestCluster.Run
+	Subtests []platform.SubtestResult
+}
+
+// Attempt records the outcome of a single try at running a test.
+type Attempt struct {
 	Result   error
 	Duration time.Duration
 }
 
-func testRunner(platform string, done <-chan struct{}, tests chan *Test, results chan *Result) {
-	for test := range tests {
+// runAttempts runs the test up to 1+TestRetries times until it passes.
+func runAttempts(test *Test, pltfrm string) *Result {
+	r := &Result{Test: test, Platform: pltfrm}
+	for i := 0; i <= TestRetries; i++ {
+		if i > 0 {
+			plog.Noticef("=== RETRY %s on %s (attempt %d)", test.Name, pltfrm, i+1)
+		}
+
 		start := time.Now()
-		err := RunTest(test, platform)
+		err := runTest(r)
 		duration := time.Since(start)
 
+		r.Attempts = append(r.Attempts, Attempt{err, duration})
+		r.Result = err
+		r.Duration += duration
+		if err == nil || platform.IsSkip(err) {
+			break
+		}
+	}
+	return r
+}
+
+func testRunner(platform string, done <-chan struct{}, tests chan *Test, results chan *Result) {
+	for test := range tests {
+		r := runAttempts(test, platform)
+
 		select {
-		case results <- &Result{test, err, duration}:
+		case results <- r:
 		case <-done:
 			return
 		}
 	}
 }
 
-func filterTests(tests map[string]*Test, pattern, platform string) (map[string]*Test, error) {
+// capabilities returns the capabilities pltfrm provides on this host.
+func capabilities(pltfrm string) []string {
+	if pltfrm == "qemu" {
+		return platform.QEMUCapabilities(QEMUOptions)
+	}
+	return platform.Capabilities[pltfrm]
+}
+
+// filterTests returns the tests to run on pltfrm. Selected tests that
+// require capabilities pltfrm lacks are returned as skipped results.
+func filterTests(tests map[string]*Test, pattern, pltfrm string, include, exclude TagExpr) (map[string]*Test, []*Result, error) {
 	r := make(map[string]*Test)
+	var skipped []*Result
 
 	for name, t := range tests {
 		match, err := filepath.Match(pattern, t.Name)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if !match {
 			continue
@@ -110,7 +205,7 @@ func filterTests(tests map[string]*Test, pattern, platform string) (map[string]*
 
 		allowed := true
 		for _, p := range t.Platforms {
-			if p == platform {
+			if p == pltfrm {
 				allowed = true
 				break
 			} else {
@@ -121,39 +216,43 @@ func filterTests(tests map[string]*Test, pattern, platform string) (map[string]*
 			continue
 		}
 
+		if include != nil && !include.Match(t.Tags) {
+			continue
+		}
+		if exclude.Match(t.Tags) {
+			continue
+		}
+
+		missing := missingCapabilities(t.Requires, capabilities(pltfrm))
+		if len(missing) > 0 {
+			reason := fmt.Sprintf("%s lacks %s", pltfrm, strings.Join(missing, ", "))
+			skipped = append(skipped, &Result{
+				Test:     t,
+				Platform: pltfrm,
+				Result:   &platform.SkipError{Reason: reason},
+			})
+			continue
+		}
+
 		r[name] = t
 	}
 
-	return r, nil
+	return r, skipped, nil
 }
 
-// test runner and kola entry point
-func RunTests(pattern, pltfrm string) error {
-	var passed, failed int
-	var wg sync.WaitGroup
-
-	tests, err := filterTests(Tests, pattern, pltfrm)
-	if err != nil {
-		plog.Fatal(err)
-	}
-
-	done := make(chan struct{})
-	defer close(done)
+// startPlatform runs tests on pltfrm with up to parallel tests at a
+// time, sending results to results. wg is marked done once all tests
+// have finished.
+func startPlatform(pltfrm string, parallel int, tests map[string]*Test, done <-chan struct{}, results chan *Result, wg *sync.WaitGroup) {
 	testc := make(chan *Test)
-	resc := make(chan *Result)
-
-	wg.Add(TestParallelism)
 
-	for i := 0; i < TestParallelism; i++ {
+	wg.Add(parallel)
+	for i := 0; i < parallel; i++ {
 		go func() {
-			testRunner(pltfrm, done, testc, resc)
+			testRunner(pltfrm, done, testc, results)
 			wg.Done()
 		}()
 	}
-	go func() {
-		wg.Wait()
-		close(resc)
-	}()
 
 	// feed pipeline
 	go func() {
@@ -166,61 +265,229 @@ func RunTests(pattern, pltfrm string) error {
 		}
 		close(testc)
 	}()
+}
+
+// test runner and kola entry point, runs tests on all of the given
+// platforms concurrently.
+func RunTests(pattern string, pltfrms []string) error {
+	var passed, flaky, failed, timedout, skipped int
+	var results []*Result
+	var wg sync.WaitGroup
+
+	include, err := ParseTagExpr(IncludeTags)
+	if err != nil {
+		return err
+	}
+	exclude, err := ParseTagExpr(ExcludeTags)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	resc := make(chan *Result)
+
+	var unsupported []*Result
+	for _, pltfrm := range pltfrms {
+		tests, skips, err := filterTests(Tests, pattern, pltfrm, include, exclude)
+		if err != nil {
+			plog.Fatal(err)
+		}
+		unsupported = append(unsupported, skips...)
+
+		parallel := PlatformParallelism[pltfrm]
+		if parallel <= 0 {
+			parallel = TestParallelism
+		}
+		startPlatform(pltfrm, parallel, tests, done, resc, &wg)
+	}
+	go func() {
+		for _, r := range unsupported {
+			select {
+			case resc <- r:
+			case <-done:
+				return
+			}
+		}
+		wg.Wait()
+		close(resc)
+	}()
 
 	for r := range resc {
 		t := r.Test
 		err := r.Result
+		pltfrm := r.Platform
 		seconds := r.Duration.Seconds()
-		if err != nil {
+		switch r.Status() {
+		case "SKIP":
+			plog.Noticef("--- SKIP: %s on %s (%.3fs)", t.Name, pltfrm, seconds)
+			plog.Noticef("        %v", err)
+			skipped++
+		case "TIMEOUT":
+			plog.Errorf("--- TIMEOUT: %s on %s (%.3fs)", t.Name, pltfrm, seconds)
+			plog.Errorf("        %v", err)
+			timedout++
+		case "FAIL":
 			plog.Errorf("--- FAIL: %s on %s (%.3fs)", t.Name, pltfrm, seconds)
 			plog.Errorf("        %v", err)
 			failed++
-		} else {
+		case "FLAKY":
+			plog.Warningf("--- FLAKY: %s on %s (%.3fs)", t.Name, pltfrm, seconds)
+			for i, a := range r.Attempts[:len(r.Attempts)-1] {
+				plog.Warningf("        attempt %d: %v", i+1, a.Result)
+			}
+			flaky++
+		default:
 			plog.Noticef("--- PASS: %s on %s (%.3fs)", t.Name, pltfrm, seconds)
 			passed++
 		}
+		results = append(results, r)
 	}
 
-	plog.Noticef("%d passed %d failed out of %d total", passed, failed, passed+failed)
-	if failed > 0 {
-		return fmt.Errorf("%d tests failed", failed)
+	if len(pltfrms) > 1 {
+		if err := WriteSummaryTable(os.Stdout, results); err != nil {
+			return err
+		}
+	}
+
+	plog.Noticef("%d passed %d flaky %d failed %d timed out %d skipped out of %d total",
+		passed, flaky, failed, timedout, skipped, passed+flaky+failed+timedout+skipped)
+
+	if err := writeReports(results); err != nil {
+		return fmt.Errorf("writing reports: %v", err)
+	}
+
+	if failed > 0 || timedout > 0 {
+		return fmt.Errorf("%d tests failed, %d timed out", failed, timedout)
 	}
 	return nil
 }
 
 // create a cluster and run test
 func RunTest(t *Test, pltfrm string) error {
-	var err error
-	var cluster platform.Cluster
+	return runTest(&Result{Test: t, Platform: pltfrm})
+}
 
+// runTest runs r.Test on r.Platform, recording details about the run
+// such as the machines used in r. The test's error is returned.
+func runTest(r *Result) error {
+	t, pltfrm := r.Test, r.Platform
+	cluster, err := newCluster(t, pltfrm)
+	if err != nil {
+		return fmt.Errorf("Cluster failed: %v", err)
+	}
+	rc := &recordingCluster{Cluster: cluster, result: r}
+	if OutputDir != "" {
+		rc.artifactDir = testOutputDir(r)
+	}
+	defer func() {
+		if err := rc.Destroy(); err != nil {
+			plog.Errorf("cluster.Destroy(): %v", err)
+		}
+	}()
+
+	err = runTestTimeout(t, rc)
+	r.Subtests = rc.subtests.Results()
+
+	if err != nil && !platform.IsSkip(err) && rc.artifactDir != "" {
+		// save what we can from the machines before they are
+		// destroyed, without running anything on them if they hung
+		_, timedOut := err.(*TimeoutError)
+		plog.Noticef("collecting artifacts from %s on %s in %s", t.Name, pltfrm, rc.artifactDir)
+		for _, m := range rc.Machines() {
+			rc.collect(m, !timedOut)
+		}
+		r.Artifacts = append(r.Artifacts, rc.collected()...)
+	} else {
+		rc.discard()
+	}
+
+	return err
+}
+
+// newCluster creates a cluster on pltfrm for running t. Unit tests of
+// the harness replace it to use fake clusters.
+var newCluster = func(t *Test, pltfrm string) (platform.Cluster, error) {
 	switch pltfrm {
 	case "qemu":
-		cluster, err = platform.NewQemuCluster(QEMUOptions)
+		return platform.NewQemuCluster(qemuOptions(t))
+	case "nspawn":
+		return platform.NewNSpawnCluster(NSpawnOptions)
 	case "gce":
-		cluster, err = platform.NewGCECluster(GCEOptions)
+		return platform.NewGCECluster(GCEOptions)
 	case "aws":
-		cluster, err = platform.NewAWSCluster(AWSOptions)
+		return platform.NewAWSCluster(AWSOptions)
 	default:
-		err = fmt.Errorf("invalid platform %q", pltfrm)
+		return nil, fmt.Errorf("invalid platform %q", pltfrm)
 	}
+}
 
-	if err != nil {
-		return fmt.Errorf("Cluster failed: %v", err)
+// qemuOptions returns QEMUOptions with the machine resources requested
+// by t applied.
+func qemuOptions(t *Test) platform.QEMUOptions {
+	opts := QEMUOptions
+	if t.Memory != 0 {
+		opts.Memory = t.Memory
 	}
-	defer func() {
-		if err := cluster.Destroy(); err != nil {
-			plog.Errorf("cluster.Destroy(): %v", err)
-		}
+	if t.CPUs != 0 {
+		opts.CPUs = t.CPUs
+	}
+	if len(t.ExtraDisks) != 0 {
+		opts.ExtraDisks = t.ExtraDisks
+	}
+	if len(t.Networks) != 0 {
+		opts.Networks = t.Networks
+	}
+	if t.Firmware != "" {
+		opts.Firmware = t.Firmware
+	}
+	return opts
+}
+
+// runTestTimeout runs the test on rc, giving up once the test's
+// timeout has passed.
+func runTestTimeout(t *Test, rc *recordingCluster) error {
+	timeout := t.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	if timeout <= 0 {
+		return runTestCluster(t, rc)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- runTestCluster(t, rc)
 	}()
 
-	url, err := cluster.GetDiscoveryURL(t.ClusterSize)
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(timeout):
+		// The test goroutine cannot be stopped directly. Refuse any
+		// new machines and leave runTest to destroy the existing
+		// ones, which fails any SSH calls the test is blocked on.
+		rc.cancel()
+		terr := &TimeoutError{Timeout: timeout, Stacks: goroutineStacks()}
+		plog.Errorf("%s timed out after %v, goroutine stacks:\n%s",
+			t.Name, timeout, terr.Stacks)
+		return terr
+	}
+}
+
+// runTestCluster starts the test's machines on cluster and runs it.
+func runTestCluster(t *Test, cluster *recordingCluster) error {
+	// the URL is made available to the cloud config template
+	_, err := cluster.GetDiscoveryURL(t.ClusterSize)
 	if err != nil {
 		return fmt.Errorf("Failed to create discovery endpoint: %v", err)
 	}
 
-	cfgs := makeConfigs(url, t.CloudConfig, t.ClusterSize)
-
 	if t.ClusterSize > 0 {
+		cfgs := make([]*platform.UserData, t.ClusterSize)
+		for i := range cfgs {
+			cfgs[i] = platform.CloudConfig(t.CloudConfig)
+		}
 		_, err := platform.NewMachines(cluster, cfgs)
 		if err != nil {
 			return fmt.Errorf("Cluster failed starting machines: %v", err)
@@ -232,6 +499,7 @@ func RunTest(t *Test, pltfrm string) error {
 	for k := range t.NativeFuncs {
 		names = append(names, k)
 	}
+	sort.Strings(names)
 
 	// prevent unsafe access if tests ever become parallel and access
 	tempTestOptions := make(map[string]string, 0)
@@ -244,6 +512,7 @@ func RunTest(t *Test, pltfrm string) error {
 		Name:        t.Name,
 		NativeFuncs: names,
 		Options:     tempTestOptions,
+		Subtests:    &cluster.subtests,
 		Cluster:     cluster,
 	}
 
@@ -258,40 +527,190 @@ func RunTest(t *Test, pltfrm string) error {
 	// run test
 	err = t.Run(tcluster)
 
-	// give some time for the remote journal to be flushed so it can be read
-	// before we run the deferred machine destruction
-	if err != nil {
+	// without artifact collection give some time for the remote journal
+	// to be flushed so it can be read before the machines are destroyed
+	if err != nil && !platform.IsSkip(err) && OutputDir == "" {
 		time.Sleep(10 * time.Second)
 	}
 
 	return err
 }
 
-// scpKolet searches for a kolet binary and copies it to the machine.
+// goroutineStacks returns the stack traces of all running goroutines.
+func goroutineStacks() []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// recordingCluster wraps a Cluster to note the ID of every machine the
+// test creates in its Result, including machines it destroys itself.
+// Artifacts are saved to artifactDir, if set, from machines the test
+// destroys in case it fails later. Once cancelled, machines can no
+// longer be created.
+type recordingCluster struct {
+	platform.Cluster
+	mu          sync.Mutex
+	result      *Result
+	subtests    platform.Subtests
+	cancelled   bool
+	artifactDir string
+	artifacts   map[string][]string // paths saved for each machine ID
+}
+
+func (rc *recordingCluster) NewMachine(userdata *platform.UserData) (platform.Machine, error) {
+	m, err := rc.Cluster.NewMachine(userdata)
+	if m == nil {
+		return m, err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.cancelled {
+		// the cluster may already be destroyed, don't leak this one
+		m.Destroy()
+		return nil, fmt.Errorf("test cancelled")
+	}
+	rc.result.MachineIDs = append(rc.result.MachineIDs, m.ID())
+	return &recordingMachine{m, rc}, err
+}
+
+func (rc *recordingCluster) cancel() {
+	rc.mu.Lock()
+	rc.cancelled = true
+	rc.mu.Unlock()
+}
+
+// collect saves artifacts from m once, see collectArtifacts.
+func (rc *recordingCluster) collect(m platform.Machine, runCommands bool) {
+	rc.mu.Lock()
+	if rc.artifactDir == "" || rc.artifacts[m.ID()] != nil {
+		rc.mu.Unlock()
+		return
+	}
+	if rc.artifacts == nil {
+		rc.artifacts = make(map[string][]string)
+	}
+	rc.artifacts[m.ID()] = []string{}
+	rc.mu.Unlock()
+
+	paths := collectArtifacts(m, filepath.Join(rc.artifactDir, m.ID()), runCommands)
+
+	rc.mu.Lock()
+	rc.artifacts[m.ID()] = paths
+	rc.mu.Unlock()
+}
+
+// collected returns the paths of all artifacts saved so far.
+func (rc *recordingCluster) collected() []string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	var ids []string
+	for id := range rc.artifacts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var paths []string
+	for _, id := range ids {
+		paths = append(paths, rc.artifacts[id]...)
+	}
+	return paths
+}
+
+// discard removes the artifacts saved from destroyed machines of a test
+// that didn't fail after all.
+func (rc *recordingCluster) discard() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for id := range rc.artifacts {
+		if err := os.RemoveAll(filepath.Join(rc.artifactDir, id)); err != nil {
+			plog.Errorf("removing artifacts: %v", err)
+		}
+	}
+	// these are only removed if nothing else was saved in them
+	os.Remove(rc.artifactDir)
+	os.Remove(filepath.Dir(rc.artifactDir))
+}
+
+// recordingMachine saves artifacts from a machine before the test
+// destroys it.
+type recordingMachine struct {
+	platform.Machine
+	rc *recordingCluster
+}
+
+func (rm *recordingMachine) Destroy() error {
+	rm.rc.mu.Lock()
+	cancelled := rm.rc.cancelled
+	rm.rc.mu.Unlock()
+
+	// after a timeout runTest is done collecting
+	if !cancelled {
+		rm.rc.collect(rm.Machine, true)
+	}
+	return rm.Machine.Destroy()
+}
+
+// Unwrap returns the platform's machine, see platform.Unwrap.
+func (rm *recordingMachine) Unwrap() platform.Machine {
+	return rm.Machine
+}
+
+// koletDir holds a kolet binary for each arch, e.g. arm64/kolet.
+var koletDir = "/usr/lib/kola"
+
+// scpKolet copies a kolet binary built for each machine's architecture
+// to the machine.
 func scpKolet(t platform.TestCluster) error {
-	// TODO: determine the GOARCH for the remote machine
-	mArch := "amd64"
-	for _, d := range []string{
-		".",
-		filepath.Dir(os.Args[0]),
-		filepath.Join("/usr/lib/kola", mArch),
-	} {
-		kolet := filepath.Join(d, "kolet")
-		if _, err := os.Stat(kolet); err == nil {
-			return t.DropFile(kolet)
+	return t.ForEach(func(m platform.Machine) error {
+		out, err := m.SSH("uname -m")
+		if err != nil {
+			return fmt.Errorf("detecting architecture: %v", err)
 		}
+		mArch, err := sdk.UnameArch(string(out))
+		if err != nil {
+			return err
+		}
+
+		kolet, err := findKolet(mArch)
+		if err != nil {
+			return err
+		}
+		return m.CopyTo(kolet, "kolet", 0755)
+	})
+}
+
+// isLocalArch reports whether the Portage arch is the one kola was built
+// for. Unlike sdk.LocalArch it doesn't panic on hosts Portage has no arch
+// for; those simply never match.
+func isLocalArch(arch string) bool {
+	if runtime.GOARCH == "386" {
+		return arch == "x86"
 	}
-	return fmt.Errorf("Unable to locate kolet binary for %s", mArch)
+	return arch == runtime.GOARCH
 }
 
-// replaces $discovery with discover url in etcd cloud config and
-// replaces $name with a unique name
-func makeConfigs(url, cfg string, csize int) []string {
-	cfg = strings.Replace(cfg, "$discovery", url, -1)
+// findKolet searches for a kolet binary for arch. One next to kola or
+// in the current directory is assumed to be built for the local arch.
+func findKolet(arch string) (string, error) {
+	var dirs []string
+	if isLocalArch(arch) {
+		dirs = append(dirs, ".", filepath.Dir(os.Args[0]))
+	}
+	dirs = append(dirs, filepath.Join(koletDir, arch))
 
-	var cfgs []string
-	for i := 0; i < csize; i++ {
-		cfgs = append(cfgs, strings.Replace(cfg, "$name", "instance"+strconv.Itoa(i), -1))
+	for _, d := range dirs {
+		kolet := filepath.Join(d, "kolet")
+		if _, err := os.Stat(kolet); err == nil {
+			return kolet, nil
+		}
 	}
-	return cfgs
+	return "", fmt.Errorf("Unable to locate kolet binary for %s", arch)
 }
@@ -0,0 +1,317 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kola
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/mantle/platform"
+)
+
+// useFakeClusters makes the harness create fake clusters, returning
+// those created so far and a function restoring the real ones.
+func useFakeClusters(setup func(*platform.FakeCluster)) (func() []*platform.FakeCluster, func()) {
+	var clusters []*platform.FakeCluster
+	orig := newCluster
+	newCluster = func(t *Test, pltfrm string) (platform.Cluster, error) {
+		fc := platform.NewFakeCluster()
+		if setup != nil {
+			setup(fc)
+		}
+		clusters = append(clusters, fc)
+		return fc, nil
+	}
+	created := func() []*platform.FakeCluster { return clusters }
+	return created, func() { newCluster = orig }
+}
+
+func TestRunTestFake(t *testing.T) {
+	created, restore := useFakeClusters(func(fc *platform.FakeCluster) {
+		fc.Handle("systemctl is-active etcd2", platform.FakeResponse{Stdout: "active\n"})
+	})
+	defer restore()
+
+	test := &Test{
+		Name:        "fake",
+		ClusterSize: 2,
+		CloudConfig: "#cloud-config\nhostname: {{.Name}}\n",
+		Run: func(c platform.TestCluster) error {
+			for _, m := range c.Machines() {
+				out, err := m.SSH("systemctl is-active etcd2")
+				if err != nil {
+					return err
+				}
+				if string(out) != "active" {
+					return errors.New("etcd2 is not active")
+				}
+			}
+			return nil
+		},
+	}
+
+	r := &Result{Test: test, Platform: "fake"}
+	if err := runTest(r); err != nil {
+		t.Fatalf("runTest: %v", err)
+	}
+
+	clusters := created()
+	if len(clusters) != 1 {
+		t.Fatalf("created %d clusters, want 1", len(clusters))
+	}
+	fc := clusters[0]
+	if !fc.Destroyed() {
+		t.Errorf("cluster was not destroyed")
+	}
+	if len(r.MachineIDs) != 2 {
+		t.Errorf("recorded machines %v, want 2", r.MachineIDs)
+	}
+	if cmds := fc.Commands(); len(cmds) != 2 {
+		t.Errorf("ran commands %v, want 2", cmds)
+	}
+}
+
+func TestRunTestArtifacts(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "kola-harness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	origOutputDir := OutputDir
+	OutputDir = tmp
+	defer func() { OutputDir = origOutputDir }()
+
+	_, restore := useFakeClusters(func(fc *platform.FakeCluster) {
+		fc.HandleFunc("journalctl .*", func(m *platform.FakeMachine, cmd string) platform.FakeResponse {
+			return platform.FakeResponse{Stdout: "journal of " + m.ID()}
+		})
+	})
+	defer restore()
+
+	fail := true
+	test := &Test{
+		Name:        "broken",
+		ClusterSize: 1,
+		CloudConfig: "#cloud-config\nhostname: {{.Name}}\n",
+		Run: func(c platform.TestCluster) error {
+			// a machine the test destroys itself
+			m, err := c.NewMachine(nil)
+			if err != nil {
+				return err
+			}
+			m.Destroy()
+
+			if fail {
+				return errors.New("it broke")
+			}
+			return nil
+		},
+	}
+
+	r := &Result{Test: test, Platform: "fake"}
+	if err := runTest(r); err == nil || err.Error() != "it broke" {
+		t.Fatalf("runTest: got %v, want it broke", err)
+	}
+
+	var names []string
+	for _, path := range r.Artifacts {
+		rel, _ := filepath.Rel(tmp, path)
+		names = append(names, rel)
+	}
+	want := "fake/broken/attempt1/fake0/journal.txt fake/broken/attempt1/fake0/user-data fake/broken/attempt1/fake1/journal.txt"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("collected %q, want %q", got, want)
+	}
+
+	journal, err := ioutil.ReadFile(filepath.Join(tmp, "fake", "broken", "attempt1", "fake1", "journal.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(journal) != "journal of fake1" {
+		t.Errorf("unexpected journal %q", journal)
+	}
+
+	// nothing is kept from destroyed machines of a passing test
+	fail = false
+	r = &Result{Test: test, Platform: "fake", Attempts: []Attempt{{}}}
+	if err := runTest(r); err != nil {
+		t.Fatalf("runTest: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "fake", "broken", "attempt2")); !os.IsNotExist(err) {
+		t.Errorf("artifacts of a passing test were kept: %v", err)
+	}
+}
+
+func TestRunAttemptsFlaky(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "kola-harness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	created, restore := useFakeClusters(nil)
+	defer restore()
+
+	origRetries, origOutputDir := TestRetries, OutputDir
+	TestRetries, OutputDir = 2, tmp
+	defer func() { TestRetries, OutputDir = origRetries, origOutputDir }()
+
+	runs := 0
+	test := &Test{
+		Name: "flaky",
+		Run: func(c platform.TestCluster) error {
+			runs++
+			if _, err := c.NewMachine(nil); err != nil {
+				return err
+			}
+			if runs == 1 {
+				return errors.New("first try fails")
+			}
+			return nil
+		},
+	}
+
+	r := runAttempts(test, "fake")
+	if r.Status() != "FLAKY" || runs != 2 {
+		t.Errorf("got %s after %d runs, want FLAKY after 2", r.Status(), runs)
+	}
+	if len(r.MachineIDs) != 2 {
+		t.Errorf("recorded machines %v, want one per attempt", r.MachineIDs)
+	}
+
+	clusters := created()
+	if len(clusters) != 2 {
+		t.Fatalf("created %d clusters, want one per attempt", len(clusters))
+	}
+	for i, fc := range clusters {
+		if !fc.Destroyed() {
+			t.Errorf("cluster %d was not destroyed", i)
+		}
+	}
+}
+
+func TestRunTestNewMachineError(t *testing.T) {
+	_, restore := useFakeClusters(func(fc *platform.FakeCluster) {
+		fc.FailNewMachine(errors.New("out of quota"))
+	})
+	defer restore()
+
+	test := &Test{
+		Name:        "unbootable",
+		ClusterSize: 1,
+		Run: func(c platform.TestCluster) error {
+			t.Errorf("test ran without machines")
+			return nil
+		},
+	}
+
+	err := runTest(&Result{Test: test, Platform: "fake"})
+	if err == nil || !strings.Contains(err.Error(), "out of quota") {
+		t.Errorf("runTest: got %v, want out of quota", err)
+	}
+}
+
+func TestScpKolet(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "kola-harness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	origKoletDir := koletDir
+	koletDir = tmp
+	defer func() { koletDir = origKoletDir }()
+
+	kolet := filepath.Join(tmp, "arm64", "kolet")
+	if err := os.MkdirAll(filepath.Dir(kolet), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(kolet, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fc := platform.NewFakeCluster()
+	defer fc.Destroy()
+	for i := 0; i < 2; i++ {
+		if _, err := fc.NewMachine(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fc.Handle("uname -m", platform.FakeResponse{Stdout: "aarch64\n"})
+
+	c := platform.TestCluster{Name: "kolet", Cluster: fc}
+	if err := scpKolet(c); err != nil {
+		t.Fatalf("scpKolet: %v", err)
+	}
+	for _, m := range fc.Machines() {
+		copies := m.(*platform.FakeMachine).Copies()
+		if len(copies) != 1 || copies[0].LocalPath != kolet || copies[0].RemotePath != "kolet" {
+			t.Errorf("%s got copies %v, want the arm64 kolet", m.ID(), copies)
+		}
+	}
+
+	// no kolet for this one
+	fc.Machines()[1].(*platform.FakeMachine).Handle("uname -m", platform.FakeResponse{Stdout: "ppc64\n"})
+	err = scpKolet(c)
+	if err == nil || !strings.Contains(err.Error(), "fake1: Unable to locate kolet binary for ppc64") {
+		t.Errorf("scpKolet: got %v, want fake1 to fail", err)
+	}
+}
+
+func TestRunTestTimeout(t *testing.T) {
+	created, restore := useFakeClusters(nil)
+	defer restore()
+
+	release := make(chan struct{})
+	returned := make(chan error)
+	test := &Test{
+		Name:    "hang",
+		Timeout: 100 * time.Millisecond,
+		Run: func(c platform.TestCluster) error {
+			<-release
+			_, err := c.NewMachine(nil)
+			returned <- err
+			return err
+		},
+	}
+
+	r := runAttempts(test, "fake")
+	if r.Status() != "TIMEOUT" {
+		t.Fatalf("got %s, want TIMEOUT", r.Status())
+	}
+	if terr := r.Result.(*TimeoutError); !strings.Contains(string(terr.Stacks), "TestRunTestTimeout.func1") {
+		t.Errorf("stacks do not include the hung test:\n%s", terr.Stacks)
+	}
+
+	clusters := created()
+	if len(clusters) != 1 || !clusters[0].Destroyed() {
+		t.Fatalf("cluster was not destroyed")
+	}
+
+	// the hung test carries on but can't create machines any more
+	close(release)
+	if err := <-returned; err == nil || err.Error() != "test cancelled" {
+		t.Errorf("NewMachine after cancel: got %v, want test cancelled", err)
+	}
+	if len(r.MachineIDs) != 0 {
+		t.Errorf("recorded machines %v after cancel", r.MachineIDs)
+	}
+}
@@ -14,27 +14,68 @@
 
 package kola
 
-import "github.com/coreos/mantle/kola/tests/misc"
+import (
+	"github.com/coreos/mantle/kola/tests/misc"
+	"github.com/coreos/mantle/platform"
+)
 
 //register new tests here
-// "$name" and "$discovery" are substituted in the cloud config during cluster creation
+// cloud configs are user data templates, see platform.RenderUserData
 func init() {
 	Register(&Test{
 		Run:         misc.NFSv3,
 		ClusterSize: 0,
 		Name:        "NFSv3",
+		Tags:        []string{"network", "nfs"},
 		Platforms:   []string{"qemu", "aws"},
 	})
 	Register(&Test{
 		Run:         misc.NFSv4,
 		ClusterSize: 0,
 		Name:        "NFSv4",
+		Tags:        []string{"network", "nfs"},
 		Platforms:   []string{"qemu", "aws"},
 	})
 	Register(&Test{
 		Run:         misc.NTP,
 		ClusterSize: 0,
 		Name:        "NTP",
+		Tags:        []string{"network"},
 		Platforms:   []string{"qemu"},
 	})
+	Register(&Test{
+		Run:         misc.RebootPersist,
+		ClusterSize: 0,
+		Name:        "RebootPersist",
+		Tags:        []string{"reboot"},
+	})
+	Register(&Test{
+		Run:         misc.PowerCycle,
+		ClusterSize: 0,
+		Name:        "PowerCycle",
+		Tags:        []string{"reboot"},
+		Requires:    []string{platform.CapQMP},
+	})
+	Register(&Test{
+		Run:         misc.MultiNIC,
+		ClusterSize: 0,
+		Name:        "MultiNIC",
+		Tags:        []string{"network"},
+		Requires:    []string{platform.CapMultiNIC},
+		Networks:    []string{"br0", "br1", "br2"},
+	})
+	Register(&Test{
+		Run:         misc.ScriptUserData,
+		ClusterSize: 0,
+		Name:        "ScriptUserData",
+		Tags:        []string{"userdata"},
+	})
+	Register(&Test{
+		Run:         misc.UEFIBoot,
+		ClusterSize: 1,
+		Name:        "UEFIBoot",
+		Tags:        []string{"boot"},
+		Requires:    []string{platform.CapUEFI},
+		Firmware:    "uefi",
+	})
 }
@@ -0,0 +1,325 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kola
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coreos/mantle/platform"
+)
+
+// jsonResult is the serialized form of a Result in JSON reports.
+type jsonResult struct {
+	Name       string   `json:"name"`
+	Platform   string   `json:"platform"`
+	Status     string   `json:"status"`
+	Duration   float64  `json:"duration"` // seconds
+	Error      string   `json:"error,omitempty"`
+	MachineIDs []string `json:"machine_ids,omitempty"`
+	Artifacts  []string `json:"artifacts,omitempty"`
+
+	Attempts []jsonAttempt `json:"attempts"`
+	Subtests []jsonSubtest `json:"subtests,omitempty"`
+}
+
+type jsonSubtest struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration"` // seconds
+	Error    string  `json:"error,omitempty"`
+}
+
+type jsonAttempt struct {
+	Duration float64 `json:"duration"` // seconds
+	Error    string  `json:"error,omitempty"`
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+
+	total time.Duration
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+
+	// Failed attempts of tests that passed on a retry, in the same
+	// format as the Maven Surefire plugin's rerunFailingTestsCount.
+	FlakyFailures []junitFailure `xml:"flakyFailure,omitempty"`
+	SystemOut     string         `xml:"system-out,omitempty"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// Status returns a short description of the outcome of the test.
+func (r *Result) Status() string {
+	if _, ok := r.Result.(*TimeoutError); ok {
+		return "TIMEOUT"
+	}
+	if platform.IsSkip(r.Result) {
+		return "SKIP"
+	}
+	if r.Result != nil {
+		return "FAIL"
+	}
+	if len(r.Attempts) > 1 {
+		return "FLAKY"
+	}
+	return "PASS"
+}
+
+// WriteJSONReport writes results to w as a JSON array.
+func WriteJSONReport(w io.Writer, results []*Result) error {
+	out := make([]jsonResult, 0, len(results))
+	for _, r := range results {
+		jr := jsonResult{
+			Name:       r.Test.Name,
+			Platform:   r.Platform,
+			Status:     r.Status(),
+			Duration:   r.Duration.Seconds(),
+			MachineIDs: r.MachineIDs,
+			Artifacts:  r.Artifacts,
+		}
+		if r.Result != nil {
+			jr.Error = r.Result.Error()
+		}
+		for _, a := range r.Attempts {
+			ja := jsonAttempt{Duration: a.Duration.Seconds()}
+			if a.Result != nil {
+				ja.Error = a.Result.Error()
+			}
+			jr.Attempts = append(jr.Attempts, ja)
+		}
+		for _, st := range r.Subtests {
+			js := jsonSubtest{
+				Name:     st.Name,
+				Status:   "PASS",
+				Duration: st.Duration.Seconds(),
+			}
+			if platform.IsSkip(st.Result) {
+				js.Status = "SKIP"
+				js.Error = st.Result.Error()
+			} else if st.Result != nil {
+				js.Status = "FAIL"
+				js.Error = st.Result.Error()
+			}
+			jr.Subtests = append(jr.Subtests, js)
+		}
+		out = append(out, jr)
+	}
+
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = w.Write(b)
+	return err
+}
+
+// WriteJUnitReport writes results to w in the JUnit XML format
+// understood by Jenkins. Each platform becomes its own test suite.
+func WriteJUnitReport(w io.Writer, results []*Result) error {
+	var suites junitTestSuites
+	index := make(map[string]int)
+
+	for _, r := range results {
+		i, ok := index[r.Platform]
+		if !ok {
+			i = len(suites.Suites)
+			index[r.Platform] = i
+			suites.Suites = append(suites.Suites, junitTestSuite{
+				Name: "kola." + r.Platform,
+			})
+		}
+		suite := &suites.Suites[i]
+
+		tc := junitTestCase{
+			Name:      r.Test.Name,
+			Classname: "kola." + r.Platform,
+			Time:      fmt.Sprintf("%.3f", r.Duration.Seconds()),
+		}
+		var out []string
+		if len(r.MachineIDs) > 0 {
+			out = append(out, "machines: "+strings.Join(r.MachineIDs, " "))
+		}
+		if len(r.Artifacts) > 0 {
+			out = append(out, "artifacts: "+strings.Join(r.Artifacts, " "))
+		}
+		tc.SystemOut = strings.Join(out, "\n")
+		switch r.Status() {
+		case "TIMEOUT":
+			// JUnit reports tests that never completed as errors
+			tc.Error = &junitFailure{
+				Message: r.Result.Error(),
+				Type:    "timeout",
+				Text:    r.Result.Error(),
+			}
+			suite.Errors++
+		case "SKIP":
+			tc.Skipped = &junitSkipped{
+				Message: r.Result.(*platform.SkipError).Reason,
+			}
+			suite.Skipped++
+		case "FAIL":
+			tc.Failure = &junitFailure{
+				Message: r.Result.Error(),
+				Text:    r.Result.Error(),
+			}
+			suite.Failures++
+		case "FLAKY":
+			for _, a := range r.Attempts[:len(r.Attempts)-1] {
+				tc.FlakyFailures = append(tc.FlakyFailures, junitFailure{
+					Message: a.Result.Error(),
+					Text:    a.Result.Error(),
+				})
+			}
+		}
+
+		suite.Tests++
+		suite.total += r.Duration
+		suite.Time = fmt.Sprintf("%.3f", suite.total.Seconds())
+		suite.Cases = append(suite.Cases, tc)
+
+		// subtests are reported as test cases of their own, named
+		// after their parent as go test does
+		for _, st := range r.Subtests {
+			stc := junitTestCase{
+				Name:      r.Test.Name + "/" + st.Name,
+				Classname: tc.Classname,
+				Time:      fmt.Sprintf("%.3f", st.Duration.Seconds()),
+			}
+			if skip, ok := st.Result.(*platform.SkipError); ok {
+				stc.Skipped = &junitSkipped{Message: skip.Reason}
+				suite.Skipped++
+			} else if st.Result != nil {
+				stc.Failure = &junitFailure{
+					Message: st.Result.Error(),
+					Text:    st.Result.Error(),
+				}
+				suite.Failures++
+			}
+			suite.Tests++
+			suite.Cases = append(suite.Cases, stc)
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// WriteSummaryTable writes a table of the status of each test on each
+// platform in results to w.
+func WriteSummaryTable(w io.Writer, results []*Result) error {
+	var names, pltfrms []string
+	status := make(map[string]map[string]string)
+	seen := make(map[string]bool)
+	for _, r := range results {
+		if status[r.Test.Name] == nil {
+			status[r.Test.Name] = make(map[string]string)
+			names = append(names, r.Test.Name)
+		}
+		status[r.Test.Name][r.Platform] = r.Status()
+
+		if !seen[r.Platform] {
+			seen[r.Platform] = true
+			pltfrms = append(pltfrms, r.Platform)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(pltfrms)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "TEST\t%s\n", strings.Join(pltfrms, "\t"))
+	for _, name := range names {
+		row := []string{name}
+		for _, p := range pltfrms {
+			s, ok := status[name][p]
+			if !ok {
+				s = "-" // not run on this platform
+			}
+			row = append(row, s)
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func writeReportFile(path string, results []*Result, write func(io.Writer, []*Result) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f, results); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeReports writes the reports requested by JUnitReport and JSONReport.
+func writeReports(results []*Result) error {
+	if JUnitReport != "" {
+		if err := writeReportFile(JUnitReport, results, WriteJUnitReport); err != nil {
+			return err
+		}
+	}
+	if JSONReport != "" {
+		if err := writeReportFile(JSONReport, results, WriteJSONReport); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kola
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coreos/mantle/platform"
+)
+
+var reportResults = []*Result{
+	{
+		Test:       &Test{Name: "pass"},
+		Platform:   "qemu",
+		Duration:   1500 * time.Millisecond,
+		MachineIDs: []string{"m1"},
+	},
+	{
+		Test:     &Test{Name: "fail"},
+		Platform: "qemu",
+		Result:   errors.New("it broke"),
+		Duration: time.Second,
+		Subtests: []platform.SubtestResult{
+			{Name: "a", Duration: time.Second},
+			{Name: "b", Result: errors.New("b broke")},
+		},
+	},
+	{
+		Test:     &Test{Name: "pass"},
+		Platform: "gce",
+		Duration: time.Second,
+	},
+	{
+		Test:     &Test{Name: "flake"},
+		Platform: "gce",
+		Duration: 2 * time.Second,
+		Attempts: []Attempt{
+			{errors.New("no ssh"), time.Second},
+			{nil, time.Second},
+		},
+	},
+	{
+		Test:     &Test{Name: "internet"},
+		Platform: "qemu",
+		Result:   &platform.SkipError{Reason: "qemu lacks internet"},
+	},
+	{
+		Test:     &Test{Name: "hang"},
+		Platform: "gce",
+		Result:   &TimeoutError{Timeout: time.Minute},
+		Duration: time.Minute,
+	},
+}
+
+func TestWriteJSONReport(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteJSONReport(&buf, reportResults); err != nil {
+		t.Fatalf("WriteJSONReport failed: %v", err)
+	}
+
+	var out []jsonResult
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.Bytes())
+	}
+	if len(out) != 6 {
+		t.Fatalf("expected 6 results, got %d", len(out))
+	}
+	if out[0].Status != "PASS" || out[0].Duration != 1.5 || out[0].MachineIDs[0] != "m1" {
+		t.Errorf("unexpected first result: %+v", out[0])
+	}
+	if out[1].Status != "FAIL" || out[1].Error != "it broke" || len(out[1].Subtests) != 2 {
+		t.Errorf("unexpected second result: %+v", out[1])
+	}
+	if out[3].Status != "FLAKY" || len(out[3].Attempts) != 2 || out[3].Attempts[0].Error != "no ssh" {
+		t.Errorf("unexpected fourth result: %+v", out[3])
+	}
+	if out[4].Status != "SKIP" {
+		t.Errorf("unexpected fifth result: %+v", out[4])
+	}
+	if out[5].Status != "TIMEOUT" {
+		t.Errorf("unexpected sixth result: %+v", out[5])
+	}
+}
+
+func TestWriteJUnitReport(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteJUnitReport(&buf, reportResults); err != nil {
+		t.Fatalf("WriteJUnitReport failed: %v", err)
+	}
+
+	var out junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, buf.Bytes())
+	}
+	if len(out.Suites) != 2 {
+		t.Fatalf("expected 2 suites, got %d", len(out.Suites))
+	}
+
+	qemu := out.Suites[0]
+	if qemu.Name != "kola.qemu" || qemu.Tests != 5 || qemu.Failures != 2 || qemu.Skipped != 1 || qemu.Time != "2.500" {
+		t.Errorf("unexpected qemu suite: %+v", qemu)
+	}
+	if qemu.Cases[1].Failure == nil || qemu.Cases[1].Failure.Message != "it broke" {
+		t.Errorf("missing failure: %+v", qemu.Cases[1])
+	}
+	if qemu.Cases[3].Name != "fail/b" || qemu.Cases[3].Failure == nil {
+		t.Errorf("unexpected subtest case: %+v", qemu.Cases[3])
+	}
+	if qemu.Cases[4].Skipped == nil || qemu.Cases[4].Skipped.Message != "qemu lacks internet" {
+		t.Errorf("unexpected skipped case: %+v", qemu.Cases[4])
+	}
+
+	gce := out.Suites[1]
+	if gce.Tests != 3 || gce.Failures != 0 || gce.Errors != 1 {
+		t.Errorf("unexpected gce suite: %+v", gce)
+	}
+	if len(gce.Cases[1].FlakyFailures) != 1 || gce.Cases[1].Failure != nil {
+		t.Errorf("unexpected flaky test case: %+v", gce.Cases[1])
+	}
+	if gce.Cases[2].Error == nil || gce.Cases[2].Error.Type != "timeout" {
+		t.Errorf("missing timeout error: %+v", gce.Cases[2])
+	}
+}
+
+func TestWriteSummaryTable(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSummaryTable(&buf, reportResults); err != nil {
+		t.Fatalf("WriteSummaryTable failed: %v", err)
+	}
+
+	expected := `TEST      gce      qemu
+fail      -        FAIL
+flake     FLAKY    -
+hang      TIMEOUT  -
+internet  -        SKIP
+pass      PASS     PASS
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected table:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
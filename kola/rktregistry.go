@@ -17,11 +17,12 @@ package kola
 import "github.com/coreos/mantle/kola/tests/rkt"
 
 //register new tests here
-// "$name" and "$discovery" are substituted in the cloud config during cluster creation
+// cloud configs are user data templates, see platform.RenderUserData
 func init() {
 	Register(&Test{
 		Run:         rkt.Install,
 		ClusterSize: 0,
 		Name:        "RktInstall",
+		Tags:        []string{"rkt"},
 	})
 }
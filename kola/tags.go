@@ -0,0 +1,99 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kola
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TagExpr selects tests by their tags. It is a list of alternatives
+// separated by commas, each of which is a list of terms joined by '+'
+// that must all hold. A term is a tag name, optionally prefixed by '!'
+// to require that the tag is absent. For example "etcd+!slow,network"
+// matches fast etcd tests and all network tests.
+//
+// The empty expression matches nothing.
+type TagExpr [][]tagTerm
+
+type tagTerm struct {
+	tag    string
+	negate bool
+}
+
+// ParseTagExpr parses a TagExpr from s.
+func ParseTagExpr(s string) (TagExpr, error) {
+	var expr TagExpr
+	if strings.TrimSpace(s) == "" {
+		return expr, nil
+	}
+
+	for _, alt := range strings.Split(s, ",") {
+		var terms []tagTerm
+		for _, t := range strings.Split(alt, "+") {
+			t = strings.TrimSpace(t)
+			term := tagTerm{tag: strings.TrimPrefix(t, "!")}
+			term.negate = term.tag != t
+			if term.tag == "" || strings.ContainsAny(term.tag, "!") {
+				return nil, fmt.Errorf("invalid tag expression %q", s)
+			}
+			terms = append(terms, term)
+		}
+		expr = append(expr, terms)
+	}
+
+	return expr, nil
+}
+
+// Match reports whether a test with the given tags satisfies e.
+func (e TagExpr) Match(tags []string) bool {
+	has := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		has[t] = true
+	}
+
+	for _, terms := range e {
+		matched := true
+		for _, term := range terms {
+			if has[term.tag] == term.negate {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// missingCapabilities returns the capabilities in required that are not
+// in provided.
+func missingCapabilities(required, provided []string) []string {
+	var missing []string
+	for _, r := range required {
+		found := false
+		for _, p := range provided {
+			if r == p {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kola
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/mantle/platform"
+)
+
+func TestTagExpr(t *testing.T) {
+	for _, tt := range []struct {
+		expr  string
+		tags  []string
+		match bool
+	}{
+		{"", []string{"etcd"}, false},
+		{"etcd", []string{"etcd"}, true},
+		{"etcd", []string{"fleet"}, false},
+		{"etcd,fleet", []string{"fleet"}, true},
+		{"etcd+slow", []string{"etcd"}, false},
+		{"etcd+slow", []string{"slow", "etcd"}, true},
+		{"etcd+!slow", []string{"etcd"}, true},
+		{"etcd+!slow", []string{"etcd", "slow"}, false},
+		{"!slow", nil, true},
+		{" etcd + !slow , network ", []string{"network", "slow"}, true},
+	} {
+		e, err := ParseTagExpr(tt.expr)
+		if err != nil {
+			t.Errorf("ParseTagExpr(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if m := e.Match(tt.tags); m != tt.match {
+			t.Errorf("%q.Match(%v) = %v, expected %v", tt.expr, tt.tags, m, tt.match)
+		}
+	}
+}
+
+func TestTagExprInvalid(t *testing.T) {
+	for _, expr := range []string{",", "etcd+", "!", "!!etcd", "a,,b"} {
+		if _, err := ParseTagExpr(expr); err == nil {
+			t.Errorf("ParseTagExpr(%q) succeeded, expected error", expr)
+		}
+	}
+}
+
+func TestFilterTestsCapabilities(t *testing.T) {
+	tests := map[string]*Test{
+		"local":    {Name: "local"},
+		"internet": {Name: "internet", Requires: []string{"internet"}},
+		"slow":     {Name: "slow", Tags: []string{"slow"}},
+	}
+	exclude, _ := ParseTagExpr("slow")
+
+	qemu, skipped, err := filterTests(tests, "*", "qemu", nil, exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qemu) != 1 || qemu["local"] == nil {
+		t.Errorf("unexpected tests for qemu: %v", qemu)
+	}
+	if len(skipped) != 1 || skipped[0].Test.Name != "internet" || skipped[0].Status() != "SKIP" {
+		t.Errorf("unexpected skipped tests for qemu: %v", skipped)
+	}
+
+	gce, skipped, err := filterTests(tests, "*", "gce", nil, exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gce) != 2 || gce["internet"] == nil {
+		t.Errorf("unexpected tests for gce: %v", gce)
+	}
+	if len(skipped) != 0 {
+		t.Errorf("unexpected skipped tests for gce: %v", skipped)
+	}
+}
+
+func TestFilterTestsUEFI(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "kola-tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	orig := QEMUOptions
+	defer func() { QEMUOptions = orig }()
+
+	tests := map[string]*Test{
+		"uefi": {Name: "uefi", Requires: []string{platform.CapUEFI}},
+	}
+
+	// without OVMF the test is skipped rather than failing to boot
+	QEMUOptions.OVMFCode = filepath.Join(tmp, "OVMF_CODE.fd")
+	QEMUOptions.OVMFVars = filepath.Join(tmp, "OVMF_VARS.fd")
+	run, skipped, err := filterTests(tests, "*", "qemu", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(run) != 0 || len(skipped) != 1 || skipped[0].Status() != "SKIP" {
+		t.Errorf("got %v to run and %v skipped, want uefi skipped", run, skipped)
+	}
+
+	for _, path := range []string{QEMUOptions.OVMFCode, QEMUOptions.OVMFVars} {
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run, skipped, err = filterTests(tests, "*", "qemu", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(run) != 1 || len(skipped) != 0 {
+		t.Errorf("got %v to run and %v skipped, want uefi to run", run, skipped)
+	}
+}
@@ -14,15 +14,7 @@ var plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "kola/tests/cor
 
 // run various native functions that only require a single machine
 func LocalTests(c platform.TestCluster) error {
-	tests := c.ListNativeFunctions()
-	for _, name := range tests {
-		plog.Noticef("running %v...", name)
-		err := c.RunNative(name, c.Machines()[0])
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return c.RunNativeSubtests(c.Machines()[0])
 }
 
 // run clustering based tests
@@ -60,27 +52,10 @@ func ClusterTests(c platform.TestCluster) error {
 		}
 	}
 
-	tests := c.ListNativeFunctions()
-	for _, name := range tests {
-		plog.Noticef("running %v...", name)
-		err := c.RunNative(name, c.Machines()[0])
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-
+	return c.RunNativeSubtests(c.Machines()[0])
 }
 
 // run internet based tests
 func InternetTests(c platform.TestCluster) error {
-	tests := c.ListNativeFunctions()
-	for _, name := range tests {
-		plog.Noticef("running %v...", name)
-		err := c.RunNative(name, c.Machines()[0])
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return c.RunNativeSubtests(c.Machines()[0])
 }
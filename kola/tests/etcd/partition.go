@@ -0,0 +1,91 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/util"
+)
+
+// Partition one member away from a three member cluster and check that
+// the majority keeps accepting writes while the isolated member refuses
+// them, and that the cluster recovers once the partition heals.
+func Partition(c platform.TestCluster) error {
+	machines := c.Machines()
+	csize := len(machines)
+	if csize < 3 {
+		return fmt.Errorf("partition test needs at least 3 machines, got %d", csize)
+	}
+
+	for _, m := range machines {
+		if err := doStart(m, 2, false); err != nil {
+			return err
+		}
+	}
+	if err := getClusterHealth(machines[0], csize); err != nil {
+		return err
+	}
+
+	keys, err := SetKeys(c, 3)
+	if err != nil {
+		return err
+	}
+
+	isolated, majority := machines[0], machines[1:]
+	plog.Infof("partitioning %s from the rest of the cluster", isolated.IP())
+	if err := c.Partition([]platform.Machine{isolated}, majority); err != nil {
+		return fmt.Errorf("partitioning cluster: %v", err)
+	}
+
+	// the majority may need to elect a new leader first
+	write := func() error {
+		return putKey(majority[0], "partition", "majority")
+	}
+	if err := util.Retry(10, 5*time.Second, write); err != nil {
+		return fmt.Errorf("majority rejected write during partition: %v", err)
+	}
+
+	if err := putKey(isolated, "partition", "minority"); err == nil {
+		return fmt.Errorf("isolated member accepted a write during partition")
+	}
+
+	plog.Info("healing partition")
+	if err := c.Heal(); err != nil {
+		return fmt.Errorf("healing partition: %v", err)
+	}
+	if err := getClusterHealth(isolated, csize); err != nil {
+		return err
+	}
+
+	keys["partition"] = "majority"
+	return CheckKeys(c, keys, true)
+}
+
+// putKey sets key to value through the etcd member on m.
+func putKey(m platform.Machine, key, value string) error {
+	cmd := fmt.Sprintf("curl --max-time 10 -w %%{http_code} -s http://127.0.0.1:2379/v2/keys/%v -XPUT -d value=%v", key, value)
+	b, err := m.SSH(cmd)
+	if err != nil {
+		return fmt.Errorf("writing key on %s: %v", m.IP(), err)
+	}
+	if !bytes.HasSuffix(b, []byte("200")) && !bytes.HasSuffix(b, []byte("201")) {
+		return fmt.Errorf("writing key on %s: unexpected response %s", m.IP(), b)
+	}
+	return nil
+}
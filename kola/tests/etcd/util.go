@@ -64,19 +64,17 @@ func SetKeys(cluster platform.Cluster, n int) (map[string]string, error) {
 			value := strconv.Itoa(rand.Int())[0:3]
 
 			cmd := fmt.Sprintf("curl -w %%{http_code} -s http://127.0.0.1:2379/v2/keys/%v -XPUT -d value=%v", key, value)
-			s, err := m.SSHSession()
+			res, err := m.Run(cmd, nil)
 			if err != nil {
-				return nil, err
+				plog.Infof("setting key %v on %v: %v", key, m.ID(), err)
+				continue
 			}
-			defer s.Close()
-
-			b, err := s.Output(cmd)
-			if err != nil {
+			if !res.Success() {
 				continue
 			}
 
 			// check for 201 or 200 resp header
-			if !bytes.HasSuffix(b, []byte("200")) && !bytes.HasSuffix(b, []byte("201")) {
+			if !bytes.HasSuffix(res.Stdout, []byte("200")) && !bytes.HasSuffix(res.Stdout, []byte("201")) {
 				continue
 			}
 
@@ -92,57 +90,65 @@ func SetKeys(cluster platform.Cluster, n int) (map[string]string, error) {
 }
 
 // checkKeys tests that each node in the cluster has the full provided
-// key set in keyMap. Quorum get must be used.
+// key set in keyMap. Quorum get must be used. The machines are checked
+// concurrently and the error names each machine that failed.
 func CheckKeys(cluster platform.Cluster, keyMap map[string]string, quorum bool) error {
-	for i, m := range cluster.Machines() {
+	err := platform.Parallel(cluster.Machines(), func(m platform.Machine) error {
 		for k, v := range keyMap {
-			var cmd string
-			if quorum {
-				cmd = fmt.Sprintf("curl http://127.0.0.1:2379/v2/keys/%v?quorum=true", k)
-			} else {
-				cmd = fmt.Sprintf("curl http://127.0.0.1:2379/v2/keys/%v", k)
-			}
-			s, err := m.SSHSession()
-			if err != nil {
+			if err := checkKey(m, k, v, quorum); err != nil {
 				return err
 			}
-			defer s.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-			b, err := s.Output(cmd)
-			if err != nil {
-				return fmt.Errorf("error curling key: %v", err)
-			}
+	plog.Infof("checked %v keys", len(keyMap))
+	return nil
+}
 
-			var jsonMap map[string]interface{}
-			err = json.Unmarshal(b, &jsonMap)
-			if err != nil {
-				return err
-			}
+func checkKey(m platform.Machine, k, v string, quorum bool) error {
+	var cmd string
+	if quorum {
+		cmd = fmt.Sprintf("curl http://127.0.0.1:2379/v2/keys/%v?quorum=true", k)
+	} else {
+		cmd = fmt.Sprintf("curl http://127.0.0.1:2379/v2/keys/%v", k)
+	}
 
-			// error code?
-			errorCode, ok := jsonMap["errorCode"]
-			if ok {
-				msg := jsonMap["message"]
-				return fmt.Errorf("machine %v errorCode %v: %v: %s", i, errorCode, msg, b)
-			}
+	b, err := m.SSH(cmd)
+	if err != nil {
+		return fmt.Errorf("error curling key: %v", err)
+	}
 
-			node, ok := jsonMap["node"]
-			if !ok {
-				return fmt.Errorf("retrieving key in CheckKeys, no node in resp")
-			}
+	var jsonMap map[string]interface{}
+	err = json.Unmarshal(b, &jsonMap)
+	if err != nil {
+		return err
+	}
 
-			n := node.(map[string]interface{})
-			value, ok := n["value"]
-			if !ok {
-				return fmt.Errorf("retrieving key in CheckKeys, no value in resp")
-			}
+	// error code?
+	errorCode, ok := jsonMap["errorCode"]
+	if ok {
+		msg := jsonMap["message"]
+		return fmt.Errorf("errorCode %v: %v: %s", errorCode, msg, b)
+	}
 
-			if value != v {
-				return fmt.Errorf("checkKeys got incorrect value! expected:%v got: %v", v, value)
-			}
-		}
+	node, ok := jsonMap["node"]
+	if !ok {
+		return fmt.Errorf("retrieving key in CheckKeys, no node in resp")
+	}
+
+	n := node.(map[string]interface{})
+	value, ok := n["value"]
+	if !ok {
+		return fmt.Errorf("retrieving key in CheckKeys, no value in resp")
+	}
+
+	if value != v {
+		return fmt.Errorf("checkKeys got incorrect value! expected:%v got: %v", v, value)
 	}
-	plog.Infof("checked %v keys", len(keyMap))
 	return nil
 }
 
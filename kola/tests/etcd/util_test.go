@@ -0,0 +1,141 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coreos/mantle/platform"
+)
+
+// commands run by SetKeys and CheckKeys
+const (
+	putKeyCmd = `curl -w %\{http_code\} -s http://127\.0\.0\.1:2379/v2/keys/(\w+) -XPUT -d value=(\w+)`
+	getKeyCmd = `curl http://127\.0\.0\.1:2379/v2/keys/(\w+)(\?quorum=true)?`
+)
+
+var (
+	putKeyRe = regexp.MustCompile("^" + putKeyCmd + "$")
+	getKeyRe = regexp.MustCompile("^" + getKeyCmd + "$")
+)
+
+// fakeEtcd answers the etcd requests made by SetKeys and CheckKeys
+// from a single key space shared by all machines.
+func fakeEtcd(fc *platform.FakeCluster) map[string]string {
+	var mu sync.Mutex
+	keys := make(map[string]string)
+
+	fc.HandleFunc(putKeyCmd, func(m *platform.FakeMachine, cmd string) platform.FakeResponse {
+		match := putKeyRe.FindStringSubmatch(cmd)
+		mu.Lock()
+		defer mu.Unlock()
+		keys[match[1]] = match[2]
+		return platform.FakeResponse{Stdout: fmt.Sprintf(`{"action":"set","node":{"key":"/%s","value":"%s"}}201`, match[1], match[2])}
+	})
+	fc.HandleFunc(getKeyCmd, func(m *platform.FakeMachine, cmd string) platform.FakeResponse {
+		match := getKeyRe.FindStringSubmatch(cmd)
+		mu.Lock()
+		defer mu.Unlock()
+		value, ok := keys[match[1]]
+		if !ok {
+			return platform.FakeResponse{Stdout: `{"errorCode":100,"message":"Key not found"}`}
+		}
+		return platform.FakeResponse{Stdout: fmt.Sprintf(`{"action":"get","node":{"key":"/%s","value":"%s"}}`, match[1], value)}
+	})
+	return keys
+}
+
+func newFakeCluster(t *testing.T, size int) *platform.FakeCluster {
+	fc := platform.NewFakeCluster()
+	for i := 0; i < size; i++ {
+		if _, err := fc.NewMachine(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fc
+}
+
+func TestSetCheckKeys(t *testing.T) {
+	fc := newFakeCluster(t, 3)
+	defer fc.Destroy()
+	keys := fakeEtcd(fc)
+
+	written, err := SetKeys(fc, 5)
+	if err != nil {
+		t.Fatalf("SetKeys: %v", err)
+	}
+	if len(written) == 0 || len(written) != len(keys) {
+		t.Errorf("SetKeys returned %d keys, etcd has %d", len(written), len(keys))
+	}
+
+	if err := CheckKeys(fc, written, true); err != nil {
+		t.Errorf("CheckKeys: %v", err)
+	}
+	if n := len(fc.Commands()); n != 3*5+3*len(written) {
+		t.Errorf("ran %d commands, want one per key set and one per key checked on each machine", n)
+	}
+
+	// a machine that lost a write
+	for k := range written {
+		fc.Machines()[1].(*platform.FakeMachine).Handle(
+			"curl http://127.0.0.1:2379/v2/keys/"+k+"?quorum=true",
+			platform.FakeResponse{Stdout: `{"errorCode":100,"message":"Key not found"}`})
+		break
+	}
+	err = CheckKeys(fc, written, true)
+	if err == nil || !strings.HasPrefix(err.Error(), "1 machine(s) failed: fake1: ") {
+		t.Errorf("CheckKeys: got %v, want an error naming fake1", err)
+	}
+}
+
+func TestSetKeysUnreachable(t *testing.T) {
+	fc := newFakeCluster(t, 2)
+	defer fc.Destroy()
+	keys := fakeEtcd(fc)
+
+	// a machine that is down isn't an error
+	fc.Machines()[0].(*platform.FakeMachine).FailSSH(errors.New("connection refused"))
+	written, err := SetKeys(fc, 2)
+	if err != nil {
+		t.Fatalf("SetKeys: %v", err)
+	}
+	if len(written) == 0 || len(written) != len(keys) {
+		t.Errorf("SetKeys returned %d keys, etcd has %d", len(written), len(keys))
+	}
+
+	// unless no keys could be set at all
+	fc.Machines()[1].(*platform.FakeMachine).FailSSH(errors.New("connection refused"))
+	if _, err := SetKeys(fc, 1); err == nil {
+		t.Errorf("SetKeys: expected an error when every machine is unreachable")
+	}
+}
+
+func TestSetKeysRejected(t *testing.T) {
+	fc := newFakeCluster(t, 2)
+	defer fc.Destroy()
+
+	// every write fails on every machine
+	fc.HandleFunc(`curl .* -XPUT .*`, func(m *platform.FakeMachine, cmd string) platform.FakeResponse {
+		return platform.FakeResponse{Stdout: `{"errorCode":110,"message":"The request requires user authentication"}401`}
+	})
+	if _, err := SetKeys(fc, 2); err == nil {
+		t.Errorf("SetKeys: expected an error when no keys were written")
+	}
+}
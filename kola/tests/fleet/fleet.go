@@ -34,10 +34,10 @@ var (
 	masterconf = config.CloudConfig{
 		CoreOS: config.CoreOS{
 			Etcd2: config.Etcd2{
-				AdvertiseClientURLs:      "http://$private_ipv4:2379",
-				InitialAdvertisePeerURLs: "http://$private_ipv4:2380",
+				AdvertiseClientURLs:      "http://{{.PrivateIPv4}}:2379",
+				InitialAdvertisePeerURLs: "http://{{.PrivateIPv4}}:2380",
 				ListenClientURLs:         "http://0.0.0.0:2379,http://0.0.0.0:4001",
-				ListenPeerURLs:           "http://$private_ipv4:2380,http://$private_ipv4:7001",
+				ListenPeerURLs:           "http://{{.PrivateIPv4}}:2380,http://{{.PrivateIPv4}}:7001",
 			},
 			Fleet: config.Fleet{
 				EtcdRequestTimeout: 15,
@@ -110,15 +110,19 @@ func copyFile(mach platform.Machine, r io.Reader, path string) error {
 
 // Test fleet running through an etcd2 proxy.
 func Proxy(c platform.TestCluster) error {
-	masterconf.CoreOS.Etcd2.Discovery, _ = c.GetDiscoveryURL(1)
-	master, err := c.NewMachine(masterconf.String())
+	// the test may run on several platforms at once, so the shared
+	// configs are copied rather than modified
+	mconf, pconf := masterconf, proxyconf
+
+	mconf.CoreOS.Etcd2.Discovery, _ = c.GetDiscoveryURL(1)
+	master, err := c.NewMachine(platform.CloudConfig(mconf.String()))
 	if err != nil {
 		return fmt.Errorf("Cluster.NewMachine: %s", err)
 	}
 	defer master.Destroy()
 
-	proxyconf.CoreOS.Etcd2.Discovery = masterconf.CoreOS.Etcd2.Discovery
-	proxy, err := c.NewMachine(proxyconf.String())
+	pconf.CoreOS.Etcd2.Discovery = mconf.CoreOS.Etcd2.Discovery
+	proxy, err := c.NewMachine(platform.CloudConfig(pconf.String()))
 	if err != nil {
 		return fmt.Errorf("Cluster.NewMachine: %s", err)
 	}
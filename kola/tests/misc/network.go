@@ -0,0 +1,70 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/util"
+)
+
+// Test that networkd configures every interface of a machine with
+// several network interfaces, and that machines can reach each other
+// on each network.
+func MultiNIC(c platform.TestCluster) error {
+	m1, err := c.NewMachine(nil)
+	if err != nil {
+		return fmt.Errorf("Cluster.NewMachine: %s", err)
+	}
+	defer m1.Destroy()
+
+	m2, err := c.NewMachine(nil)
+	if err != nil {
+		return fmt.Errorf("Cluster.NewMachine: %s", err)
+	}
+	defer m2.Destroy()
+
+	nics := m1.NetworkInterfaces()
+	if len(nics) < 2 {
+		return fmt.Errorf("expected several network interfaces, got %d", len(nics))
+	}
+
+	for _, nic := range nics {
+		checker := func() error {
+			out, err := m1.SSH("ip -4 -o addr show")
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(string(out), " "+nic.IPv4+"/") {
+				return fmt.Errorf("%s not configured:\n%s", nic.IPv4, out)
+			}
+			return nil
+		}
+		if err := util.Retry(6, 5*time.Second, checker); err != nil {
+			return err
+		}
+	}
+
+	for _, nic := range m2.NetworkInterfaces() {
+		if _, err := m1.SSH("ping -c 1 -w 10 " + nic.IPv4); err != nil {
+			return fmt.Errorf("pinging %s: %v", nic.IPv4, err)
+		}
+	}
+
+	return nil
+}
@@ -71,7 +71,7 @@ Options=defaults,noexec,nfsvers=%d
 )
 
 func testNFS(c platform.TestCluster, nfsversion int) error {
-	m1, err := c.NewMachine(nfsserverconf.String())
+	m1, err := c.NewMachine(platform.CloudConfig(nfsserverconf.String()))
 	if err != nil {
 		return fmt.Errorf("Cluster.NewMachine: %s", err)
 	}
@@ -101,7 +101,7 @@ func testNFS(c platform.TestCluster, nfsversion int) error {
 		Hostname: "nfs2",
 	}
 
-	m2, err := c.NewMachine(c2.String())
+	m2, err := c.NewMachine(platform.CloudConfig(c2.String()))
 	if err != nil {
 		return fmt.Errorf("Cluster.NewMachine: %s", err)
 	}
@@ -25,7 +25,7 @@ import (
 
 // Test that timesyncd starts using the local NTP server
 func NTP(c platform.TestCluster) error {
-	m, err := c.NewMachine("")
+	m, err := c.NewMachine(nil)
 	if err != nil {
 		return fmt.Errorf("Cluster.NewMachine: %s", err)
 	}
@@ -57,7 +57,7 @@ func NTP(c platform.TestCluster) error {
 
 	err = util.Retry(60, 1*time.Second, checker)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	return nil
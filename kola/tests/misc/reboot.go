@@ -0,0 +1,101 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/coreos/mantle/platform"
+)
+
+// Test that the machine ID and files written to /etc survive a reboot.
+func RebootPersist(c platform.TestCluster) error {
+	m, err := c.NewMachine(nil)
+	if err != nil {
+		return fmt.Errorf("Cluster.NewMachine: %s", err)
+	}
+	defer m.Destroy()
+
+	before, err := m.SSH("cat /etc/machine-id")
+	if err != nil {
+		return fmt.Errorf("reading machine-id: %v", err)
+	}
+
+	if _, err := m.SSH("echo kola | sudo tee /etc/kola-reboot"); err != nil {
+		return fmt.Errorf("writing /etc/kola-reboot: %v", err)
+	}
+
+	plog.Info("Rebooting machine.")
+
+	if err := m.Reboot(); err != nil {
+		return err
+	}
+
+	after, err := m.SSH("cat /etc/machine-id")
+	if err != nil {
+		return fmt.Errorf("reading machine-id: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		return fmt.Errorf("machine-id changed from %s to %s", before, after)
+	}
+
+	out, err := m.SSH("cat /etc/kola-reboot")
+	if err != nil || string(out) != "kola" {
+		return fmt.Errorf("/etc/kola-reboot lost after reboot: %q %v", out, err)
+	}
+
+	return nil
+}
+
+// Test that data synced to disk survives a hard power cycle, and that
+// the machine boots again cleanly.
+func PowerCycle(c platform.TestCluster) error {
+	m, err := c.NewMachine(nil)
+	if err != nil {
+		return fmt.Errorf("Cluster.NewMachine: %s", err)
+	}
+	defer m.Destroy()
+
+	qmp, err := c.QMP(m)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.SSH("echo kola | sudo tee /etc/kola-power && sync"); err != nil {
+		return fmt.Errorf("writing /etc/kola-power: %v", err)
+	}
+
+	plog.Info("Power cycling machine.")
+
+	if err := qmp.PowerCycle(); err != nil {
+		return err
+	}
+
+	out, err := m.SSH("cat /etc/kola-power")
+	if err != nil || string(out) != "kola" {
+		return fmt.Errorf("/etc/kola-power lost after power cycle: %q %v", out, err)
+	}
+
+	out, err = m.SSH("systemctl --failed --no-legend")
+	if err != nil {
+		return fmt.Errorf("listing failed units: %v", err)
+	}
+	if len(out) != 0 {
+		return fmt.Errorf("units failed after power cycle:\n%s", out)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"fmt"
+
+	"github.com/coreos/mantle/platform"
+)
+
+// bootCurrent is set by the firmware to the boot entry it loaded
+const bootCurrent = "/sys/firmware/efi/efivars/BootCurrent-8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+// Test that the machine booted through UEFI firmware, and so through
+// the image's EFI system partition, rather than legacy BIOS.
+func UEFIBoot(c platform.TestCluster) error {
+	m := c.Machines()[0]
+
+	res, err := m.Run("test -d /sys/firmware/efi", nil)
+	if err != nil {
+		return err
+	}
+	if !res.Success() {
+		return fmt.Errorf("/sys/firmware/efi is missing, machine booted with BIOS")
+	}
+
+	res, err = m.Run("test -f "+bootCurrent, nil)
+	if err != nil {
+		return err
+	}
+	if !res.Success() {
+		return fmt.Errorf("firmware did not set BootCurrent")
+	}
+	return nil
+}
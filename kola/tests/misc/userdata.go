@@ -0,0 +1,46 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/util"
+)
+
+// Test that a machine booted with a script as its user data runs it,
+// and is reachable with SSH keys provided by the platform's metadata.
+func ScriptUserData(c platform.TestCluster) error {
+	m, err := c.NewMachine(platform.Script("#!/bin/sh\necho {{.Name}} > /var/tmp/mantle-script\n"))
+	if err != nil {
+		return fmt.Errorf("Cluster.NewMachine: %s", err)
+	}
+	defer m.Destroy()
+
+	checker := func() error {
+		out, err := m.SSH("cat /var/tmp/mantle-script")
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(string(out), "instance") {
+			return fmt.Errorf("unexpected script output %q", out)
+		}
+		return nil
+	}
+	return util.Retry(6, 5*time.Second, checker)
+}
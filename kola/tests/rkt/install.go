@@ -22,7 +22,7 @@ import (
 
 // Test to make sure rkt install works.
 func Install(c platform.TestCluster) error {
-	mach, err := c.NewMachine("")
+	mach, err := c.NewMachine(nil)
 	if err != nil {
 		return fmt.Errorf("Cluster.NewMachine: %s", err)
 	}
@@ -29,7 +29,6 @@ import (
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/aws/aws-sdk-go/aws"
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/coreos-cloudinit/config"
 	"github.com/coreos/mantle/Godeps/_workspace/src/golang.org/x/crypto/ssh"
 
 	"github.com/coreos/mantle/network"
@@ -40,6 +39,7 @@ type awsMachine struct {
 	cluster   *awsCluster
 	mach      *ec2.Instance
 	sshClient *ssh.Client
+	userdata  string
 }
 
 func (am *awsMachine) ID() string {
@@ -54,6 +54,10 @@ func (am *awsMachine) PrivateIP() string {
 	return *am.mach.PrivateIpAddress
 }
 
+func (am *awsMachine) NetworkInterfaces() []NetworkInterface {
+	return []NetworkInterface{{IPv4: am.PrivateIP()}}
+}
+
 func (am *awsMachine) SSHSession() (*ssh.Session, error) {
 	session, err := am.sshClient.NewSession()
 	if err != nil {
@@ -95,6 +99,54 @@ func (am *awsMachine) Destroy() error {
 	return nil
 }
 
+func (am *awsMachine) Run(cmd string, opts *RunOptions) (*RunResult, error) {
+	return runCommand(am, cmd, opts)
+}
+
+func (am *awsMachine) CopyTo(localPath, remotePath string, mode os.FileMode) error {
+	return copyTo(am, localPath, remotePath, mode)
+}
+
+func (am *awsMachine) CopyFrom(remotePath, localPath string) error {
+	return copyFrom(am, remotePath, localPath)
+}
+
+func (am *awsMachine) Reboot() error {
+	return rebootMachine(am, func() error {
+		client, err := am.cluster.agent.NewClient(am.IP())
+		if err != nil {
+			return err
+		}
+		am.sshClient.Close()
+		am.sshClient = client
+		return nil
+	})
+}
+
+func (am *awsMachine) UserData() string {
+	return am.userdata
+}
+
+func (am *awsMachine) ConsoleOutput() (string, error) {
+	input := &ec2.GetConsoleOutputInput{
+		InstanceId: am.mach.InstanceId,
+	}
+
+	output, err := am.cluster.api.GetConsoleOutput(input)
+	if err != nil {
+		return "", err
+	}
+	if output.Output == nil {
+		return "", nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(*output.Output)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 func (am *awsMachine) StartJournal() error {
 	s, err := am.SSHSession()
 	if err != nil {
@@ -118,11 +170,16 @@ type AWSOptions struct {
 	SecurityGroup string
 }
 type awsCluster struct {
-	mu    sync.Mutex
-	api   *ec2.EC2
-	conf  AWSOptions
-	agent *network.SSHAgent
-	machs map[string]*awsMachine
+	mu       sync.Mutex
+	api      *ec2.EC2
+	conf     AWSOptions
+	agent    *network.SSHAgent
+	machs    map[string]*awsMachine
+	userData userData
+
+	// keyPair is the agent's key imported into EC2, created on first
+	// use by machines whose user data can't carry SSH keys
+	keyPair string
 }
 
 func NewAWSCluster(conf AWSOptions) (Cluster, error) {
@@ -159,30 +216,41 @@ func (ac *awsCluster) NewCommand(name string, arg ...string) util.Cmd {
 	return util.NewCommand(name, arg...)
 }
 
-func (ac *awsCluster) NewMachine(userdata string) (Machine, error) {
-	cloudConfig, err := config.NewCloudConfig(userdata)
+func (ac *awsCluster) NewMachine(userdata *UserData) (Machine, error) {
+	rendered, info, err := ac.userData.render(userdata,
+		cloudinitPrivateIPv4, cloudinitPublicIPv4, ac.Machines())
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := agentKeys(ac.agent)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = ac.agent.UpdateConfig(cloudConfig); err != nil {
+	id := make([]byte, 4)
+	_, _ = rand.Read(id)
+	rendered, injected, err := injectSSHKeys(userdata, rendered, keys, fmt.Sprintf("%x", id))
+	if err != nil {
 		return nil, err
 	}
 
-	if cloudConfig.Hostname == "" {
-		id := make([]byte, 4)
-		_, _ = rand.Read(id)
-		cloudConfig.Hostname = fmt.Sprintf("%x", id)
+	keyName := ac.conf.KeyName // this is only useful if you wish to ssh in for debugging
+	if !injected {
+		// EC2 provides the key pair's key to the machine as metadata
+		if keyName, err = ac.importKeyPair(keys); err != nil {
+			return nil, err
+		}
 	}
 
-	ud := base64.StdEncoding.EncodeToString([]byte(cloudConfig.String()))
+	ud := base64.StdEncoding.EncodeToString([]byte(rendered))
 	cnt := int64(1)
 
 	inst := ec2.RunInstancesInput{
 		ImageId:        &ac.conf.AMI,
 		MinCount:       &cnt,
 		MaxCount:       &cnt,
-		KeyName:        &ac.conf.KeyName, // this is only useful if you wish to ssh in for debugging
+		KeyName:        &keyName,
 		InstanceType:   &ac.conf.InstanceType,
 		SecurityGroups: []*string{&ac.conf.SecurityGroup},
 		UserData:       &ud,
@@ -209,8 +277,9 @@ func (ac *awsCluster) NewMachine(userdata string) (Machine, error) {
 	}
 
 	mach := &awsMachine{
-		cluster: ac,
-		mach:    insts.Reservations[0].Instances[0],
+		cluster:  ac,
+		mach:     insts.Reservations[0].Instances[0],
+		userdata: rendered,
 	}
 
 	// Allow a few authentication failures in case setup is slow.
@@ -223,12 +292,16 @@ func (ac *awsCluster) NewMachine(userdata string) (Machine, error) {
 	}
 
 	if err := util.Retry(sshRetries, sshTimeout, sshchecker); err != nil {
+		err = bootError(mach, err)
 		mach.Destroy()
 		return nil, err
 	}
 
 	ac.addMach(mach)
 
+	info.PrivateIPv4, info.PublicIPv4 = mach.PrivateIP(), mach.IP()
+	ac.userData.added(mach.ID(), info)
+
 	return mach, nil
 }
 
@@ -257,14 +330,48 @@ func (ac *awsCluster) GetDiscoveryURL(size int) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	ac.userData.setDiscovery(string(body), size)
 	return string(body), nil
 }
 
+// importKeyPair imports the first of keys into EC2 once per cluster,
+// returning the key pair's name.
+func (ac *awsCluster) importKeyPair(keys []string) (string, error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	if ac.keyPair != "" {
+		return ac.keyPair, nil
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no SSH keys to import")
+	}
+
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	name := fmt.Sprintf("mantle-%x", id)
+
+	_, err := ac.api.ImportKeyPair(&ec2.ImportKeyPairInput{
+		KeyName:           &name,
+		PublicKeyMaterial: []byte(keys[0]),
+	})
+	if err != nil {
+		return "", fmt.Errorf("importing key pair: %v", err)
+	}
+	ac.keyPair = name
+	return name, nil
+}
+
 func (ac *awsCluster) Destroy() error {
 	machs := ac.Machines()
 	for _, am := range machs {
 		am.Destroy()
 	}
+	if ac.keyPair != "" {
+		if _, err := ac.api.DeleteKeyPair(&ec2.DeleteKeyPairInput{KeyName: &ac.keyPair}); err != nil {
+			plog.Errorf("deleting key pair %s: %v", ac.keyPair, err)
+		}
+	}
 	ac.agent.Close()
 	return nil
 }
@@ -0,0 +1,534 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+	"syscall"
+
+	"github.com/coreos/mantle/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+	"github.com/coreos/mantle/util"
+)
+
+// The fake platform runs in-process so kola tests and their helpers can
+// be unit tested with go test. Each FakeMachine is an SSH server that
+// records every command it is sent and answers it with a handler
+// registered by the test instead of running it. Commands without a
+// handler fail with exit status 127, like an unknown command would.
+//
+//	fc := platform.NewFakeCluster()
+//	fc.Handle("sudo systemctl start etcd2.service", platform.FakeResponse{})
+//	fc.HandleFunc(`curl .*/v2/keys/\w+`, func(m *platform.FakeMachine, cmd string) platform.FakeResponse {
+//		return platform.FakeResponse{Stdout: `{"node": {"value": "1"}}`}
+//	})
+//	m, _ := fc.NewMachine(nil)
+
+// FakeResponse is the result of a command run on a fake machine.
+type FakeResponse struct {
+	Stdout     string
+	Stderr     string
+	ExitStatus int
+}
+
+// FakeHandler answers a command run on a fake machine.
+type FakeHandler func(m *FakeMachine, cmd string) FakeResponse
+
+// FakeCommand records a command run on a fake machine.
+type FakeCommand struct {
+	Machine string // ID of the machine
+	Cmd     string
+	Stdin   string
+}
+
+// FakeCopy records a file copied to a fake machine with CopyTo.
+type FakeCopy struct {
+	LocalPath  string
+	RemotePath string
+	Mode       os.FileMode
+}
+
+type fakeRoute struct {
+	re *regexp.Regexp
+	h  FakeHandler
+}
+
+type fakeRoutes []fakeRoute
+
+func (r *fakeRoutes) add(pattern string, h FakeHandler) {
+	re := regexp.MustCompile("^(?:" + pattern + ")$")
+	*r = append(*r, fakeRoute{re, h})
+}
+
+// lookup returns the most recently added handler matching cmd.
+func (r fakeRoutes) lookup(cmd string) FakeHandler {
+	for i := len(r) - 1; i >= 0; i-- {
+		if r[i].re.MatchString(cmd) {
+			return r[i].h
+		}
+	}
+	return nil
+}
+
+// FakeCluster is a Cluster of in-process fake machines.
+type FakeCluster struct {
+	mu            sync.Mutex
+	machines      []*FakeMachine
+	created       int
+	discoveries   int
+	routes        fakeRoutes
+	commands      []FakeCommand
+	newMachineErr error
+	destroyed     bool
+	userData      userData
+}
+
+// FakeMachine is a Machine of a FakeCluster.
+type FakeMachine struct {
+	fc        *FakeCluster
+	id        string
+	ip        string
+	userdata  string
+	sshClient *ssh.Client
+
+	// protected by fc.mu
+	routes    fakeRoutes
+	commands  []FakeCommand
+	copies    []FakeCopy
+	sshErr    error
+	reboots   int
+	destroyed bool
+}
+
+func NewFakeCluster() *FakeCluster {
+	return &FakeCluster{}
+}
+
+// Handle answers commands equal to cmd with resp on every machine.
+func (fc *FakeCluster) Handle(cmd string, resp FakeResponse) {
+	fc.HandleFunc(regexp.QuoteMeta(cmd), func(*FakeMachine, string) FakeResponse {
+		return resp
+	})
+}
+
+// HandleFunc answers commands entirely matching the regular expression
+// pattern with h on every machine. Handlers registered later, and
+// those registered on the machine itself, take precedence.
+func (fc *FakeCluster) HandleFunc(pattern string, h FakeHandler) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.routes.add(pattern, h)
+}
+
+// FailNewMachine makes NewMachine return err until it is called again
+// with nil.
+func (fc *FakeCluster) FailNewMachine(err error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.newMachineErr = err
+}
+
+// Commands returns every command run on the cluster's machines so far,
+// in order.
+func (fc *FakeCluster) Commands() []FakeCommand {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return append([]FakeCommand(nil), fc.commands...)
+}
+
+// Destroyed reports whether Destroy has been called.
+func (fc *FakeCluster) Destroyed() bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.destroyed
+}
+
+func (fc *FakeCluster) NewCommand(name string, arg ...string) util.Cmd {
+	return util.NewCommand(name, arg...)
+}
+
+func (fc *FakeCluster) NewMachine(userdata *UserData) (Machine, error) {
+	fc.mu.Lock()
+	if err := fc.newMachineErr; err != nil {
+		fc.mu.Unlock()
+		return nil, err
+	}
+	n := fc.created
+	fc.created++
+	running := make([]Machine, 0, len(fc.machines))
+	for _, m := range fc.machines {
+		running = append(running, m)
+	}
+	fc.mu.Unlock()
+
+	fm := &FakeMachine{
+		fc: fc,
+		id: fmt.Sprintf("fake%d", n),
+		ip: fmt.Sprintf("10.0.%d.%d", (n+2)/256, (n+2)%256),
+	}
+
+	cfg, info, err := fc.userData.render(userdata, fm.ip, fm.ip, running)
+	if err != nil {
+		return nil, err
+	}
+	fm.userdata = cfg
+
+	if err := fm.connect(); err != nil {
+		return nil, err
+	}
+
+	fc.mu.Lock()
+	fc.machines = append(fc.machines, fm)
+	fc.mu.Unlock()
+
+	fc.userData.added(fm.ID(), info)
+
+	return Machine(fm), nil
+}
+
+// Machines returns the running machines in the order they were created.
+func (fc *FakeCluster) Machines() []Machine {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	machines := make([]Machine, 0, len(fc.machines))
+	for _, m := range fc.machines {
+		machines = append(machines, m)
+	}
+	return machines
+}
+
+func (fc *FakeCluster) EtcdEndpoint() string {
+	return "http://10.0.0.1:2379"
+}
+
+func (fc *FakeCluster) GetDiscoveryURL(size int) (string, error) {
+	fc.mu.Lock()
+	url := fmt.Sprintf("%s/v2/keys/discovery/%d", fc.EtcdEndpoint(), fc.discoveries)
+	fc.discoveries++
+	fc.mu.Unlock()
+
+	fc.userData.setDiscovery(url, size)
+	return url, nil
+}
+
+func (fc *FakeCluster) Destroy() error {
+	for _, m := range fc.Machines() {
+		m.Destroy()
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.destroyed = true
+	return nil
+}
+
+var (
+	fakeHostKey     ssh.Signer
+	fakeHostKeyErr  error
+	fakeHostKeyOnce sync.Once
+)
+
+// connect starts the machine's SSH server on one end of a socket pair
+// and connects its client to the other.
+func (fm *FakeMachine) connect() error {
+	fakeHostKeyOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			fakeHostKeyErr = err
+			return
+		}
+		fakeHostKey, fakeHostKeyErr = ssh.NewSignerFromKey(key)
+	})
+	if fakeHostKeyErr != nil {
+		return fakeHostKeyErr
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	serverConn, err := fakeConn(fds[0])
+	if err != nil {
+		syscall.Close(fds[1])
+		return err
+	}
+	clientConn, err := fakeConn(fds[1])
+	if err != nil {
+		serverConn.Close()
+		return err
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(fakeHostKey)
+	go fm.serve(serverConn, config)
+
+	conn, chans, reqs, err := ssh.NewClientConn(clientConn, fm.ip+":22", &ssh.ClientConfig{User: "core"})
+	if err != nil {
+		clientConn.Close()
+		return err
+	}
+	fm.sshClient = ssh.NewClient(conn, chans, reqs)
+	return nil
+}
+
+func fakeConn(fd int) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), "fake-ssh")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+func (fm *FakeMachine) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go fm.session(ch, reqs)
+	}
+}
+
+// session answers the single command run in a session.
+func (fm *FakeMachine) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var exec struct {
+				Command string
+			}
+			if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			// commands are answered once all their input has
+			// been read
+			stdin, _ := ioutil.ReadAll(ch)
+
+			resp := fm.run(exec.Command, string(stdin))
+			io.WriteString(ch, resp.Stdout)
+			io.WriteString(ch.Stderr(), resp.Stderr)
+			status := struct {
+				Status uint32
+			}{uint32(resp.ExitStatus)}
+			ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+			return
+		case "env", "pty-req":
+			req.Reply(true, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// run records cmd and produces its response.
+func (fm *FakeMachine) run(cmd, stdin string) FakeResponse {
+	fc := fm.fc
+	fc.mu.Lock()
+	c := FakeCommand{Machine: fm.id, Cmd: cmd, Stdin: stdin}
+	fc.commands = append(fc.commands, c)
+	fm.commands = append(fm.commands, c)
+	h := fm.routes.lookup(cmd)
+	if h == nil {
+		h = fc.routes.lookup(cmd)
+	}
+	fc.mu.Unlock()
+
+	if h == nil {
+		return FakeResponse{
+			Stderr:     fmt.Sprintf("fake: no handler for %q\n", cmd),
+			ExitStatus: 127,
+		}
+	}
+	return h(fm, cmd)
+}
+
+// Handle answers commands equal to cmd with resp on this machine only.
+func (fm *FakeMachine) Handle(cmd string, resp FakeResponse) {
+	fm.HandleFunc(regexp.QuoteMeta(cmd), func(*FakeMachine, string) FakeResponse {
+		return resp
+	})
+}
+
+// HandleFunc is like FakeCluster.HandleFunc for this machine only.
+func (fm *FakeMachine) HandleFunc(pattern string, h FakeHandler) {
+	fm.fc.mu.Lock()
+	defer fm.fc.mu.Unlock()
+	fm.routes.add(pattern, h)
+}
+
+// FailSSH makes new SSH sessions fail with err, as if the machine were
+// unreachable, until it is called again with nil.
+func (fm *FakeMachine) FailSSH(err error) {
+	fm.fc.mu.Lock()
+	defer fm.fc.mu.Unlock()
+	fm.sshErr = err
+}
+
+// Commands returns every command run on the machine so far, in order.
+func (fm *FakeMachine) Commands() []FakeCommand {
+	fm.fc.mu.Lock()
+	defer fm.fc.mu.Unlock()
+	return append([]FakeCommand(nil), fm.commands...)
+}
+
+// Copies returns every file copied to the machine with CopyTo.
+func (fm *FakeMachine) Copies() []FakeCopy {
+	fm.fc.mu.Lock()
+	defer fm.fc.mu.Unlock()
+	return append([]FakeCopy(nil), fm.copies...)
+}
+
+// Reboots returns the number of times the machine has been rebooted.
+func (fm *FakeMachine) Reboots() int {
+	fm.fc.mu.Lock()
+	defer fm.fc.mu.Unlock()
+	return fm.reboots
+}
+
+// Destroyed reports whether Destroy has been called.
+func (fm *FakeMachine) Destroyed() bool {
+	fm.fc.mu.Lock()
+	defer fm.fc.mu.Unlock()
+	return fm.destroyed
+}
+
+func (fm *FakeMachine) ID() string {
+	return fm.id
+}
+
+func (fm *FakeMachine) IP() string {
+	return fm.ip
+}
+
+func (fm *FakeMachine) PrivateIP() string {
+	return fm.ip
+}
+
+func (fm *FakeMachine) NetworkInterfaces() []NetworkInterface {
+	return []NetworkInterface{{IPv4: fm.ip}}
+}
+
+func (fm *FakeMachine) SSHSession() (*ssh.Session, error) {
+	fm.fc.mu.Lock()
+	err := fm.sshErr
+	if fm.destroyed {
+		err = fmt.Errorf("machine %s has been destroyed", fm.id)
+	}
+	fm.fc.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return fm.sshClient.NewSession()
+}
+
+func (fm *FakeMachine) SSH(cmd string) ([]byte, error) {
+	session, err := fm.SSHSession()
+	if err != nil {
+		return []byte{}, err
+	}
+	defer session.Close()
+
+	session.Stderr = os.Stderr
+	out, err := session.Output(cmd)
+	out = bytes.TrimSpace(out)
+	return out, err
+}
+
+func (fm *FakeMachine) StartJournal() error {
+	return nil
+}
+
+// Reboot sends the usual reboot command, which needs no handler, and
+// counts the reboot.
+func (fm *FakeMachine) Reboot() error {
+	if err := startReboot(fm); err != nil {
+		return err
+	}
+
+	fm.fc.mu.Lock()
+	defer fm.fc.mu.Unlock()
+	fm.reboots++
+	return nil
+}
+
+func (fm *FakeMachine) UserData() string {
+	return fm.userdata
+}
+
+func (fm *FakeMachine) ConsoleOutput() (string, error) {
+	return "", nil
+}
+
+func (fm *FakeMachine) Run(cmd string, opts *RunOptions) (*RunResult, error) {
+	return runCommand(fm, cmd, opts)
+}
+
+// CopyTo records the copy without transferring anything.
+func (fm *FakeMachine) CopyTo(localPath, remotePath string, mode os.FileMode) error {
+	fm.fc.mu.Lock()
+	defer fm.fc.mu.Unlock()
+	if fm.sshErr != nil {
+		return fm.sshErr
+	}
+	fm.copies = append(fm.copies, FakeCopy{localPath, remotePath, mode})
+	return nil
+}
+
+func (fm *FakeMachine) CopyFrom(remotePath, localPath string) error {
+	return fmt.Errorf("fake machines do not support CopyFrom")
+}
+
+func (fm *FakeMachine) Destroy() error {
+	fc := fm.fc
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fm.destroyed {
+		return nil
+	}
+	fm.destroyed = true
+	fm.sshClient.Close()
+
+	for i, m := range fc.machines {
+		if m == fm {
+			fc.machines = append(fc.machines[:i], fc.machines[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
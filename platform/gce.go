@@ -52,6 +52,7 @@ type gceCluster struct {
 	conf     *GCEOptions
 	machines map[string]*gceMachine
 	mu       sync.Mutex // protects concurrent access to machines
+	userData userData
 }
 
 type gceMachine struct {
@@ -60,6 +61,7 @@ type gceMachine struct {
 	intIP     string
 	extIP     string
 	sshClient *ssh.Client
+	userdata  string
 }
 
 func NewGCECluster(conf GCEOptions) (Cluster, error) {
@@ -122,25 +124,41 @@ func (gc *gceCluster) Destroy() error {
 }
 
 // Calling in parallel is ok
-func (gc *gceCluster) NewMachine(cloudConfig string) (Machine, error) {
-	cconfig, err := config.NewCloudConfig(cloudConfig)
+func (gc *gceCluster) NewMachine(userdata *UserData) (Machine, error) {
+	rendered, info, err := gc.userData.render(userdata,
+		cloudinitPrivateIPv4, cloudinitPublicIPv4, gc.Machines())
 	if err != nil {
 		return nil, err
 	}
-	if err = gc.sshAgent.UpdateConfig(cconfig); err != nil {
+
+	keys, err := agentKeys(gc.sshAgent)
+	if err != nil {
+		return nil, err
+	}
+	rendered, injected, err := injectSSHKeys(userdata, rendered, keys, "")
+	if err != nil {
 		return nil, err
 	}
-	cloudConfig = cconfig.String()
+
+	// keys the user data can't carry go in the sshKeys metadata item
+	var sshKeys []string
+	if !injected {
+		for _, key := range keys {
+			sshKeys = append(sshKeys, gc.sshAgent.User+":"+key)
+		}
+	}
 
 	// Create gce VM and wait for creation to succeed.
-	gm, err := GCECreateVM(gc.api, gc.conf, cloudConfig)
+	gm, err := gceCreateVM(gc.api, gc.conf, rendered, sshKeys)
 	if err != nil {
 		return nil, err
 	}
 	gm.gc = gc
+	gm.userdata = rendered
 
 	err = sshCheck(gm)
 	if err != nil {
+		err = bootError(gm, err)
 		gm.Destroy()
 		return nil, err
 	}
@@ -149,6 +167,9 @@ func (gc *gceCluster) NewMachine(cloudConfig string) (Machine, error) {
 	gc.machines[gm.ID()] = gm
 	gc.mu.Unlock()
 
+	info.PrivateIPv4, info.PublicIPv4 = gm.PrivateIP(), gm.IP()
+	gc.userData.added(gm.ID(), info)
+
 	return Machine(gm), nil
 }
 
@@ -163,6 +184,7 @@ func (gce *gceCluster) GetDiscoveryURL(size int) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	gce.userData.setDiscovery(string(body), size)
 	return string(body), nil
 }
 
@@ -178,6 +200,10 @@ func (gm *gceMachine) PrivateIP() string {
 	return gm.intIP
 }
 
+func (gm *gceMachine) NetworkInterfaces() []NetworkInterface {
+	return []NetworkInterface{{IPv4: gm.intIP}}
+}
+
 func (gm *gceMachine) SSHSession() (*ssh.Session, error) {
 	session, err := gm.sshClient.NewSession()
 	if err != nil {
@@ -216,6 +242,42 @@ func (gm *gceMachine) StartJournal() error {
 	return nil
 }
 
+func (gm *gceMachine) Run(cmd string, opts *RunOptions) (*RunResult, error) {
+	return runCommand(gm, cmd, opts)
+}
+
+func (gm *gceMachine) CopyTo(localPath, remotePath string, mode os.FileMode) error {
+	return copyTo(gm, localPath, remotePath, mode)
+}
+
+func (gm *gceMachine) CopyFrom(remotePath, localPath string) error {
+	return copyFrom(gm, remotePath, localPath)
+}
+
+func (gm *gceMachine) Reboot() error {
+	return rebootMachine(gm, func() error {
+		client, err := gm.gc.sshAgent.NewClient(gm.IP())
+		if err != nil {
+			return err
+		}
+		gm.sshClient.Close()
+		gm.sshClient = client
+		return nil
+	})
+}
+
+func (gm *gceMachine) UserData() string {
+	return gm.userdata
+}
+
+func (gm *gceMachine) ConsoleOutput() (string, error) {
+	out, err := gm.gc.api.Instances.GetSerialPortOutput(gm.gc.conf.Project, gm.gc.conf.Zone, gm.name).Do()
+	if err != nil {
+		return "", err
+	}
+	return out.Contents, nil
+}
+
 func (gm *gceMachine) Destroy() error {
 	if gm.sshClient != nil {
 		gm.sshClient.Close()
@@ -240,14 +302,19 @@ func GCECreateVM(api *compute.Service, opts *GCEOptions, userdata string) (*gceM
 			return nil, err
 		}
 	}
+	return gceCreateVM(api, opts, userdata, nil)
+}
 
+// gceCreateVM creates a VM with arbitrary user data. sshKeys, in
+// "user:key" form, are set in the instance's metadata.
+func gceCreateVM(api *compute.Service, opts *GCEOptions, userdata string, sshKeys []string) (*gceMachine, error) {
 	// generate name
 	name, err := newName(opts)
 	if err != nil {
 		return nil, fmt.Errorf("Failed allocating unique name for vm: %v\n", err)
 	}
 
-	instance, err := gceMakeInstance(opts, userdata, name)
+	instance, err := gceMakeInstance(opts, userdata, sshKeys, name)
 	if err != nil {
 		return nil, err
 	}
@@ -370,7 +437,7 @@ func GCEListImages(client *http.Client, proj, prefix string) ([]string, error) {
 }
 
 //Some code taken from: https://github.com/golang/build/blob/master/buildlet/gce.go
-func gceMakeInstance(opts *GCEOptions, userdata string, name string) (*compute.Instance, error) {
+func gceMakeInstance(opts *GCEOptions, userdata string, sshKeys []string, name string) (*compute.Instance, error) {
 	prefix := "https://www.googleapis.com/compute/v1/projects/" + opts.Project
 	instance := &compute.Instance{
 		Name:        name,
@@ -407,6 +474,12 @@ func gceMakeInstance(opts *GCEOptions, userdata string, name string) (*compute.I
 			Value: userdata,
 		})
 	}
+	if len(sshKeys) != 0 {
+		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
+			Key:   "sshKeys",
+			Value: strings.Join(sshKeys, "\n"),
+		})
+	}
 
 	return instance, nil
 }
@@ -17,6 +17,7 @@ package local
 import (
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -158,6 +159,66 @@ func (lc *LocalCluster) NewTap(bridge string) (*TunTap, error) {
 	return tap, nil
 }
 
+// NewVeth creates a veth pair in the cluster's namespace with the host
+// side attached to bridge, returning the names of both ends. The other
+// end is given the hardware address mac, ready to be moved into a
+// container. Deleting either end deletes the pair.
+func (lc *LocalCluster) NewVeth(bridge string, mac net.HardwareAddr) (string, string, error) {
+	nsExit, err := NsEnter(lc.nshandle)
+	if err != nil {
+		return "", "", err
+	}
+	defer nsExit()
+
+	suffix := fmt.Sprintf("%08x", rand.Uint32())
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: "vh" + suffix},
+		PeerName:  "vg" + suffix,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return "", "", fmt.Errorf("veth failed: %v", err)
+	}
+
+	peer, err := netlink.LinkByName(veth.PeerName)
+	if err == nil {
+		err = netlink.LinkSetHardwareAddr(peer, mac)
+	}
+	if err != nil {
+		netlink.LinkDel(veth)
+		return "", "", fmt.Errorf("veth address failed: %v", err)
+	}
+
+	br, err := netlink.LinkByName(bridge)
+	if err == nil {
+		err = netlink.LinkSetMaster(veth, br.(*netlink.Bridge))
+	}
+	if err == nil {
+		err = netlink.LinkSetUp(veth)
+	}
+	if err != nil {
+		netlink.LinkDel(veth)
+		return "", "", fmt.Errorf("veth bridge failed: %v", err)
+	}
+
+	return veth.Name, veth.PeerName, nil
+}
+
+// DeleteLink deletes the network interface name from the cluster's
+// namespace.
+func (lc *LocalCluster) DeleteLink(name string) error {
+	nsExit, err := NsEnter(lc.nshandle)
+	if err != nil {
+		return err
+	}
+	defer nsExit()
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
 func (lc *LocalCluster) Destroy() error {
 	var err error
 	firstErr := func(e error) {
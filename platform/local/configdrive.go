@@ -15,38 +15,63 @@
 package local
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
-
-	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/coreos-cloudinit/config"
 )
 
 type ConfigDrive struct {
 	Directory string
 }
 
-func NewConfigDrive(cfg *config.CloudConfig) (*ConfigDrive, error) {
+// ConfigDriveMetadata is written to the drive's meta_data.json, where
+// coreos-cloudinit reads it regardless of the user data's format.
+type ConfigDriveMetadata struct {
+	UUID     string   `json:"uuid,omitempty"`
+	Hostname string   `json:"hostname,omitempty"`
+	SSHKeys  []string `json:"-"`
+}
+
+func (m ConfigDriveMetadata) MarshalJSON() ([]byte, error) {
+	keys := make(map[string]string)
+	for i, key := range m.SSHKeys {
+		keys[fmt.Sprintf("mantle%d", i)] = key
+	}
+
+	type metadata ConfigDriveMetadata
+	return json.Marshal(struct {
+		metadata
+		PublicKeys map[string]string `json:"public_keys,omitempty"`
+	}{metadata(m), keys})
+}
+
+func NewConfigDrive(userdata string, meta ConfigDriveMetadata) (*ConfigDrive, error) {
 	drivePath, err := ioutil.TempDir("", "mantle-config-drive")
 	if err != nil {
 		return nil, err
 	}
 
-	userPath := path.Join(drivePath, "openstack/latest/user_data")
-	err = os.MkdirAll(path.Dir(userPath), 0777)
+	latest := path.Join(drivePath, "openstack/latest")
+	err = os.MkdirAll(latest, 0777)
 	if err != nil {
 		os.RemoveAll(drivePath)
 		return nil, err
 	}
 
-	userData, err := os.OpenFile(userPath, os.O_WRONLY|os.O_CREATE, 0666)
+	err = ioutil.WriteFile(path.Join(latest, "user_data"), []byte(userdata), 0666)
 	if err != nil {
 		os.RemoveAll(drivePath)
 		return nil, err
 	}
-	defer userData.Close()
 
-	_, err = userData.WriteString(cfg.String())
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		os.RemoveAll(drivePath)
+		return nil, err
+	}
+	err = ioutil.WriteFile(path.Join(latest, "meta_data.json"), metaJSON, 0666)
 	if err != nil {
 		os.RemoveAll(drivePath)
 		return nil, err
@@ -0,0 +1,107 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Network faults are injected with tc on the host side of each tap
+// device inside the cluster's namespace: netem on the tap's root qdisc
+// impairs traffic towards the machine and filters on its ingress qdisc
+// drop traffic from the machine to blocked addresses.
+
+// Impairment describes degraded network conditions for a link.
+// The zero value is a healthy link.
+type Impairment struct {
+	Delay  time.Duration // added to every packet
+	Jitter time.Duration // random variation of Delay
+	Loss   float64       // percentage of packets dropped
+}
+
+func (imp Impairment) netemArgs() []string {
+	return []string{
+		"delay", fmt.Sprintf("%dus", imp.Delay/time.Microsecond),
+		fmt.Sprintf("%dus", imp.Jitter/time.Microsecond),
+		"loss", fmt.Sprintf("%g%%", imp.Loss),
+	}
+}
+
+func (lc *LocalCluster) tc(args ...string) error {
+	cmd := lc.NewCommand("tc", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("tc %v: %v: %s", args, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// Impair applies imp to traffic sent to the machine behind tap.
+func (lc *LocalCluster) Impair(tap string, imp Impairment) error {
+	if imp.Loss < 0 || imp.Loss > 100 {
+		return fmt.Errorf("invalid packet loss %g%%", imp.Loss)
+	}
+	args := append([]string{"qdisc", "replace", "dev", tap, "root", "netem"}, imp.netemArgs()...)
+	return lc.tc(args...)
+}
+
+// Block drops all traffic from the machine behind tap to addrs until
+// Unblock is called. It may be called repeatedly to block more.
+func (lc *LocalCluster) Block(tap string, addrs []net.IP) error {
+	// adding the ingress qdisc twice is an error and replacing it
+	// would discard the existing filters
+	ingress, err := lc.hasIngress(tap)
+	if err != nil {
+		return err
+	}
+	if !ingress {
+		if err := lc.tc("qdisc", "add", "dev", tap, "ingress"); err != nil {
+			return err
+		}
+	}
+
+	for _, addr := range addrs {
+		proto, match, prefix := "ip", "ip", "/32"
+		if addr.To4() == nil {
+			proto, match, prefix = "ipv6", "ip6", "/128"
+		}
+		err := lc.tc("filter", "add", "dev", tap, "parent", "ffff:",
+			"protocol", proto, "u32", "match", match, "dst", addr.String()+prefix,
+			"action", "drop")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unblock removes everything blocked by Block on tap.
+func (lc *LocalCluster) Unblock(tap string) error {
+	ingress, err := lc.hasIngress(tap)
+	if err != nil || !ingress {
+		return err
+	}
+	return lc.tc("qdisc", "del", "dev", tap, "ingress")
+}
+
+func (lc *LocalCluster) hasIngress(tap string) (bool, error) {
+	out, err := lc.NewCommand("tc", "qdisc", "show", "dev", tap, "ingress").Output()
+	if err != nil {
+		return false, fmt.Errorf("tc qdisc show dev %s: %v", tap, err)
+	}
+	return len(bytes.TrimSpace(out)) != 0, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/coreos/mantle/platform/local"
+)
+
+// localMachine is implemented by machines attached to a LocalCluster's
+// bridges, allowing faults to be injected into their network.
+type localMachine interface {
+	Machine
+
+	localCluster() *local.LocalCluster
+
+	// taps returns the host side of each of the machine's network
+	// interfaces.
+	taps() []string
+
+	// addrs returns every address of the machine on the local network.
+	addrs() []net.IP
+}
+
+func asLocalMachine(m Machine) (localMachine, error) {
+	lm, ok := Unwrap(m).(localMachine)
+	if !ok {
+		return nil, fmt.Errorf("machine %s does not support network fault injection", m.ID())
+	}
+	return lm, nil
+}
+
+// Partition drops all network traffic between the machines in a and
+// the machines in b until Heal is called. Traffic within each group
+// and to the rest of the network is unaffected. Tests using it should
+// require CapNetFaults.
+func (t *TestCluster) Partition(a, b []Machine) error {
+	block := func(from, to []Machine) error {
+		var addrs []net.IP
+		for _, m := range to {
+			lm, err := asLocalMachine(m)
+			if err != nil {
+				return err
+			}
+			addrs = append(addrs, lm.addrs()...)
+		}
+
+		for _, m := range from {
+			lm, err := asLocalMachine(m)
+			if err != nil {
+				return err
+			}
+			for _, tap := range lm.taps() {
+				if err := lm.localCluster().Block(tap, addrs); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := block(a, b); err != nil {
+		return err
+	}
+	return block(b, a)
+}
+
+// Heal removes all partitions created by Partition.
+func (t *TestCluster) Heal() error {
+	for _, m := range t.Machines() {
+		lm, err := asLocalMachine(m)
+		if err != nil {
+			return err
+		}
+		for _, tap := range lm.taps() {
+			if err := lm.localCluster().Unblock(tap); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Impair applies imp to all network traffic sent to m. The zero
+// Impairment restores normal conditions. Tests using it should require
+// CapNetFaults.
+func (t *TestCluster) Impair(m Machine, imp local.Impairment) error {
+	lm, err := asLocalMachine(m)
+	if err != nil {
+		return err
+	}
+	for _, tap := range lm.taps() {
+		if err := lm.localCluster().Impair(tap, imp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
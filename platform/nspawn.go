@@ -0,0 +1,510 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/satori/go.uuid"
+	"github.com/coreos/mantle/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+	"github.com/coreos/mantle/platform/local"
+	"github.com/coreos/mantle/util"
+)
+
+// Machines on the nspawn platform are systemd-nspawn containers
+// booting the /usr tree of a CoreOS image on an otherwise empty root,
+// much as CoreOS boots on first start. Each has a veth attached to br0
+// of a LocalCluster so dnsmasq, etcd and SSH work as with qemu. There
+// is no kernel or bootloader of the image involved so only tests of
+// userspace are meaningful.
+
+type NSpawnOptions struct {
+	// UsrTree is a directory holding the contents of the image's
+	// /usr partition, e.g. where it is mounted.
+	UsrTree string
+}
+
+// exit status of systemd-nspawn when the container asks to reboot
+const nspawnRebootStatus = 133
+
+type nspawnCluster struct {
+	mu sync.Mutex
+	*local.LocalCluster
+	machines map[string]*nspawnMachine
+	conf     NSpawnOptions
+	userData userData
+}
+
+type nspawnMachine struct {
+	nc          *nspawnCluster
+	id          string
+	root        string
+	configDrive *local.ConfigDrive
+	netif       *local.Interface
+	sshClient   *ssh.Client
+	userdata    string
+	consolePath string
+
+	// protects the fields below, which change when the container
+	// reboots
+	mu         sync.Mutex
+	nspawn     util.Cmd
+	veth       string // host side of the container's veth
+	boots      int
+	destroying bool
+	done       chan struct{} // closed once the container has stopped
+}
+
+func NewNSpawnCluster(conf NSpawnOptions) (Cluster, error) {
+	if conf.UsrTree == "" {
+		return nil, fmt.Errorf("nspawn requires the path of an image's /usr tree")
+	}
+	if _, err := os.Stat(filepath.Join(conf.UsrTree, "lib/os-release")); err != nil {
+		return nil, fmt.Errorf("%s is not a /usr tree: %v", conf.UsrTree, err)
+	}
+
+	lc, err := local.NewLocalCluster()
+	if err != nil {
+		return nil, err
+	}
+
+	nc := &nspawnCluster{
+		LocalCluster: lc,
+		machines:     make(map[string]*nspawnMachine),
+		conf:         conf,
+	}
+	return Cluster(nc), nil
+}
+
+func (nc *nspawnCluster) GetDiscoveryURL(size int) (string, error) {
+	url, err := nc.LocalCluster.GetDiscoveryURL(size)
+	if err != nil {
+		return "", err
+	}
+	nc.userData.setDiscovery(url, size)
+	return url, nil
+}
+
+func (nc *nspawnCluster) Machines() []Machine {
+	machines := make([]Machine, 0, len(nc.machines))
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	for _, m := range nc.machines {
+		machines = append(machines, m)
+	}
+	return machines
+}
+
+func (nc *nspawnCluster) Destroy() error {
+	for _, m := range nc.Machines() {
+		m.Destroy()
+	}
+	return nc.LocalCluster.Destroy()
+}
+
+func (nc *nspawnCluster) NewMachine(userdata *UserData) (Machine, error) {
+	id := uuid.NewV4()
+
+	nc.mu.Lock()
+	netif := nc.Dnsmasq.GetInterface("br0")
+	running := make([]Machine, 0, len(nc.machines))
+	for _, m := range nc.machines {
+		running = append(running, m)
+	}
+	nc.mu.Unlock()
+
+	ip := netif.DHCPv4[0].IP.String()
+	cfg, info, err := nc.userData.render(userdata, ip, ip, running)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := agentKeys(nc.SSHAgent)
+	if err != nil {
+		return nil, err
+	}
+	cfg, injected, err := injectSSHKeys(userdata, cfg, keys, "")
+	if err != nil {
+		return nil, err
+	}
+
+	meta := local.ConfigDriveMetadata{
+		UUID:     id.String(),
+		Hostname: id.String()[:8],
+	}
+	if !injected {
+		meta.SSHKeys = keys
+	}
+	configDrive, err := local.NewConfigDrive(cfg, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	nm := &nspawnMachine{
+		nc:          nc,
+		id:          id.String(),
+		configDrive: configDrive,
+		netif:       netif,
+		userdata:    cfg,
+		done:        make(chan struct{}),
+	}
+
+	if err := nm.setupRoot(); err != nil {
+		nm.configDrive.Destroy()
+		return nil, err
+	}
+
+	console, err := ioutil.TempFile("", "mantle-nspawn-console")
+	if err != nil {
+		nm.cleanup()
+		return nil, err
+	}
+	nm.consolePath = console.Name()
+	console.Close()
+
+	cmd, veth, err := nm.start()
+	if err != nil {
+		nm.cleanup()
+		return nil, err
+	}
+	nm.nspawn, nm.veth = cmd, veth
+	go nm.supervise()
+
+	sshchecker := func() error {
+		client, err := nc.SSHAgent.NewClient(nm.IP())
+		if err != nil {
+			return err
+		}
+		nm.sshClient = client
+		return nil
+	}
+	if err := util.Retry(sshRetries, sshTimeout, sshchecker); err != nil {
+		err = bootError(nm, err)
+		nm.Destroy()
+		return nil, err
+	}
+
+	out, err := nm.SSH("grep ^ID= /etc/os-release")
+	if err != nil {
+		nm.Destroy()
+		return nil, err
+	}
+
+	if !bytes.Equal(out, []byte("ID=coreos")) {
+		nm.Destroy()
+		return nil, fmt.Errorf("Unexpected SSH output: %s", out)
+	}
+
+	nc.mu.Lock()
+	nc.machines[nm.ID()] = nm
+	nc.mu.Unlock()
+
+	nc.userData.added(nm.ID(), info)
+
+	return Machine(nm), nil
+}
+
+// setupRoot creates the container's root directory. /usr and the
+// config drive are bind mounted into it by systemd-nspawn, everything
+// else is created while booting just as on a freshly installed
+// machine.
+func (nm *nspawnMachine) setupRoot() error {
+	root, err := ioutil.TempDir("", "mantle-nspawn")
+	if err != nil {
+		return err
+	}
+	nm.root = root
+
+	for _, dir := range []string{"usr", "etc", "media/configdrive"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return err
+		}
+	}
+	for _, dir := range []string{"bin", "sbin", "lib", "lib64"} {
+		if err := os.Symlink("usr/"+dir, filepath.Join(root, dir)); err != nil {
+			return err
+		}
+	}
+
+	// systemd-nspawn only boots directories that look like an OS
+	// before /usr is mounted
+	osRelease, err := ioutil.ReadFile(filepath.Join(nm.nc.conf.UsrTree, "lib/os-release"))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(root, "etc/os-release"), osRelease, 0644)
+}
+
+// start boots the container with a new veth, returning the running
+// systemd-nspawn command and the host side of the veth.
+func (nm *nspawnMachine) start() (util.Cmd, string, error) {
+	veth, guest, err := nm.nc.NewVeth("br0", nm.netif.HardwareAddr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	console, err := os.OpenFile(nm.consolePath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		nm.nc.DeleteLink(veth)
+		return nil, "", err
+	}
+	defer console.Close()
+
+	cmd := nm.nc.NewCommand("systemd-nspawn",
+		"--quiet",
+		"--boot",
+		"--register=no",
+		"--directory="+nm.root,
+		"--machine=mantle-"+nm.id[:8],
+		"--uuid="+nm.id,
+		"--bind-ro="+nm.nc.conf.UsrTree+":/usr",
+		"--bind-ro="+nm.configDrive.Directory+":/media/configdrive",
+		"--network-interface="+guest)
+	nscmd := cmd.(*local.NsCmd)
+	nscmd.Stdout = console
+	nscmd.Stderr = console
+
+	if err := cmd.Start(); err != nil {
+		nm.nc.DeleteLink(veth)
+		return nil, "", err
+	}
+	return cmd, veth, nil
+}
+
+// supervise waits for the container to stop, booting it again if it
+// asked to be rebooted, until it stops for any other reason or the
+// machine is destroyed.
+func (nm *nspawnMachine) supervise() {
+	defer close(nm.done)
+
+	nm.mu.Lock()
+	cmd := nm.nspawn
+	nm.mu.Unlock()
+
+	for {
+		err := cmd.Wait()
+
+		nm.mu.Lock()
+		if nm.destroying || !rebootRequested(err) {
+			nm.mu.Unlock()
+			if err != nil {
+				plog.Debugf("container %s stopped: %v", nm.ID(), err)
+			}
+			return
+		}
+
+		var veth string
+		cmd, veth, err = nm.start()
+		if err != nil {
+			nm.mu.Unlock()
+			plog.Errorf("rebooting container %s failed: %v", nm.ID(), err)
+			return
+		}
+		nm.nspawn, nm.veth = cmd, veth
+		nm.boots++
+		nm.mu.Unlock()
+	}
+}
+
+func rebootRequested(err error) bool {
+	eerr, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	status, ok := eerr.Sys().(syscall.WaitStatus)
+	return ok && status.Exited() && status.ExitStatus() == nspawnRebootStatus
+}
+
+func (nm *nspawnMachine) ID() string {
+	return nm.id
+}
+
+func (nm *nspawnMachine) IP() string {
+	return nm.netif.DHCPv4[0].IP.String()
+}
+
+func (nm *nspawnMachine) PrivateIP() string {
+	return nm.netif.DHCPv4[0].IP.String()
+}
+
+func (nm *nspawnMachine) localCluster() *local.LocalCluster {
+	return nm.nc.LocalCluster
+}
+
+// taps returns the host side of the container's veth. It is replaced
+// when the container reboots, losing any network faults.
+func (nm *nspawnMachine) taps() []string {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return []string{nm.veth}
+}
+
+func (nm *nspawnMachine) addrs() []net.IP {
+	var addrs []net.IP
+	for _, a := range nm.netif.DHCPv4 {
+		addrs = append(addrs, a.IP)
+	}
+	for _, a := range nm.netif.DHCPv6 {
+		addrs = append(addrs, a.IP)
+	}
+	return addrs
+}
+
+func (nm *nspawnMachine) NetworkInterfaces() []NetworkInterface {
+	return []NetworkInterface{{
+		HardwareAddr: nm.netif.HardwareAddr.String(),
+		IPv4:         nm.netif.DHCPv4[0].IP.String(),
+		IPv6:         nm.netif.DHCPv6[0].IP.String(),
+	}}
+}
+
+func (nm *nspawnMachine) SSHSession() (*ssh.Session, error) {
+	session, err := nm.sshClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (nm *nspawnMachine) SSH(cmd string) ([]byte, error) {
+	session, err := nm.SSHSession()
+	if err != nil {
+		return []byte{}, err
+	}
+	defer session.Close()
+
+	session.Stderr = os.Stderr
+	out, err := session.Output(cmd)
+	out = bytes.TrimSpace(out)
+	return out, err
+}
+
+func (nm *nspawnMachine) StartJournal() error {
+	s, err := nm.SSHSession()
+	if err != nil {
+		return fmt.Errorf("SSH session failed: %v", err)
+	}
+
+	s.Stdout = os.Stdout
+	s.Stderr = os.Stderr
+	go func() {
+		s.Run("journalctl -f")
+		s.Close()
+	}()
+
+	return nil
+}
+
+func (nm *nspawnMachine) Run(cmd string, opts *RunOptions) (*RunResult, error) {
+	return runCommand(nm, cmd, opts)
+}
+
+func (nm *nspawnMachine) CopyTo(localPath, remotePath string, mode os.FileMode) error {
+	return copyTo(nm, localPath, remotePath, mode)
+}
+
+func (nm *nspawnMachine) CopyFrom(remotePath, localPath string) error {
+	return copyFrom(nm, remotePath, localPath)
+}
+
+// Reboot restarts the container. Containers share the host's boot ID
+// so a reboot is detected by systemd-nspawn being started again.
+func (nm *nspawnMachine) Reboot() error {
+	nm.mu.Lock()
+	boots := nm.boots
+	nm.mu.Unlock()
+
+	if err := startReboot(nm); err != nil {
+		return err
+	}
+
+	checker := func() error {
+		nm.mu.Lock()
+		rebooted := nm.boots != boots
+		nm.mu.Unlock()
+		if !rebooted {
+			return fmt.Errorf("container has not rebooted")
+		}
+
+		client, err := nm.nc.SSHAgent.NewClient(nm.IP())
+		if err != nil {
+			return err
+		}
+		nm.sshClient.Close()
+		nm.sshClient = client
+		return nil
+	}
+
+	if err := util.Retry(rebootRetries, rebootDelay, checker); err != nil {
+		return bootError(nm, fmt.Errorf("waiting for reboot of %s: %v", nm.ID(), err))
+	}
+	return nil
+}
+
+func (nm *nspawnMachine) UserData() string {
+	return nm.userdata
+}
+
+// ConsoleOutput returns everything the container's init has written
+// to its console so far, across reboots.
+func (nm *nspawnMachine) ConsoleOutput() (string, error) {
+	b, err := ioutil.ReadFile(nm.consolePath)
+	return string(b), err
+}
+
+// cleanup removes the machine's files from the host.
+func (nm *nspawnMachine) cleanup() error {
+	err := nm.configDrive.Destroy()
+	if nm.root != "" {
+		if err2 := os.RemoveAll(nm.root); err == nil {
+			err = err2
+		}
+	}
+	if nm.consolePath != "" {
+		os.Remove(nm.consolePath)
+	}
+	return err
+}
+
+func (nm *nspawnMachine) Destroy() error {
+	if nm.sshClient != nil {
+		nm.sshClient.Close()
+	}
+
+	// killing systemd-nspawn takes the whole container and its veth
+	// with it
+	nm.mu.Lock()
+	nm.destroying = true
+	nm.nspawn.(*local.NsCmd).Process.Kill()
+	nm.mu.Unlock()
+	<-nm.done
+
+	err := nm.cleanup()
+
+	nm.nc.mu.Lock()
+	delete(nm.nc.machines, nm.ID())
+	nm.nc.mu.Unlock()
+
+	return err
+}
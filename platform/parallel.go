@@ -0,0 +1,115 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// MachineError is the failure of one machine in a Parallel call.
+type MachineError struct {
+	Machine Machine
+	Err     error
+}
+
+func (e MachineError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Machine.ID(), e.Err)
+}
+
+// MachineErrors is returned by Parallel when some of the machines
+// failed, in the order the machines were given.
+type MachineErrors []MachineError
+
+func (e MachineErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, merr := range e {
+		msgs[i] = merr.Error()
+	}
+	return fmt.Sprintf("%d machine(s) failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Parallel runs f on each of machines concurrently and waits for all of
+// them to return. If any fail the error is a MachineErrors naming each
+// failed machine.
+func Parallel(machines []Machine, f func(Machine) error) error {
+	return parallel(machines, func(i int, m Machine) error {
+		return f(m)
+	})
+}
+
+// parallel is Parallel for functions that also need the machine's index.
+func parallel(machines []Machine, f func(int, Machine) error) error {
+	errs := make([]error, len(machines))
+
+	var wg sync.WaitGroup
+	for i, m := range machines {
+		wg.Add(1)
+		go func(i int, m Machine) {
+			defer wg.Done()
+			errs[i] = f(i, m)
+		}(i, m)
+	}
+	wg.Wait()
+
+	var failed MachineErrors
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, MachineError{machines[i], err})
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// ForEach runs f concurrently on the given machines, or on all of the
+// cluster's machines if none are given. See Parallel.
+func (t *TestCluster) ForEach(f func(Machine) error, machines ...Machine) error {
+	if len(machines) == 0 {
+		machines = t.Machines()
+	}
+	return Parallel(machines, f)
+}
+
+// RunAll runs cmd with Machine.Run concurrently on the given machines,
+// or on all of the cluster's machines if none are given. The results
+// are in the order of the machines, with nil for machines where cmd
+// could not be run. Unlike Machine.Run, a command exiting with a non-zero
+// status is a failure of that machine.
+func (t *TestCluster) RunAll(cmd string, opts *RunOptions, machines ...Machine) ([]*RunResult, error) {
+	if len(machines) == 0 {
+		machines = t.Machines()
+	}
+
+	results := make([]*RunResult, len(machines))
+	err := parallel(machines, func(i int, m Machine) error {
+		res, err := m.Run(cmd, opts)
+		if err != nil {
+			return err
+		}
+		results[i] = res
+
+		if res.Signal != "" {
+			return fmt.Errorf("%q killed by signal %s", cmd, res.Signal)
+		} else if res.ExitStatus != 0 {
+			return fmt.Errorf("%q exited with status %d: %s", cmd, res.ExitStatus, strings.TrimSpace(string(res.Stderr)))
+		}
+		return nil
+	})
+	return results, err
+}
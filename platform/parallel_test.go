@@ -0,0 +1,71 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParallel(t *testing.T) {
+	fc := NewFakeCluster()
+	defer fc.Destroy()
+	for i := 0; i < 3; i++ {
+		if _, err := fc.NewMachine(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &TestCluster{Name: "parallel", Cluster: fc}
+
+	// every machine waits for the others so the test only finishes if
+	// they run concurrently
+	started := make(chan struct{})
+	arrived := make(chan bool, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			<-arrived
+		}
+		close(started)
+	}()
+	err := c.ForEach(func(m Machine) error {
+		arrived <- true
+		<-started
+		if m.ID() == "fake1" {
+			return errors.New("broken")
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "1 machine(s) failed: fake1: broken" {
+		t.Errorf("ForEach: got %v, want fake1 to fail", err)
+	}
+
+	fc.Handle("uname -m", FakeResponse{Stdout: "x86_64\n"})
+	fc.Machines()[2].(*FakeMachine).Handle("uname -m", FakeResponse{Stderr: "uname: oops\n", ExitStatus: 1})
+	fc.Machines()[0].(*FakeMachine).FailSSH(errors.New("connection refused"))
+
+	results, err := c.RunAll("uname -m", nil)
+	merrs, ok := err.(MachineErrors)
+	if !ok || len(merrs) != 2 || merrs[0].Machine.ID() != "fake0" || merrs[1].Machine.ID() != "fake2" {
+		t.Fatalf("RunAll: got %v, want fake0 and fake2 to fail", err)
+	}
+	if results[0] != nil || results[1] == nil || string(results[1].Stdout) != "x86_64\n" || results[2] == nil || results[2].ExitStatus != 1 {
+		t.Errorf("RunAll: unexpected results %+v", results)
+	}
+
+	results, err = c.RunAll("uname -m", nil, fc.Machines()[1])
+	if err != nil || len(results) != 1 {
+		t.Errorf("RunAll on one machine: got %v, %v", results, err)
+	}
+}
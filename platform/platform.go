@@ -15,36 +15,125 @@
 package platform
 
 import (
+	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"time"
 
 	"path/filepath"
+	"strings"
 	"sync"
 
+	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/pkg/capnslog"
 	"github.com/coreos/mantle/Godeps/_workspace/src/golang.org/x/crypto/ssh"
 	"github.com/coreos/mantle/util"
 )
 
+var plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "platform")
+
 const (
 	sshRetries = 10
 	sshTimeout = 2 * time.Second
+
+	// number of console lines included in errors for failed boots
+	consoleTailLines = 25
+
+	// how long to wait for SSH to return after a reboot
+	rebootRetries = 60
+	rebootDelay   = 5 * time.Second
+)
+
+// Optional features a platform may provide, see Capabilities.
+const (
+	CapInternet = "internet"  // machines can reach the Internet
+	CapKVM      = "kvm"       // machines are KVM guests on the local host
+	CapMultiNIC = "multi-nic" // machines can have several network interfaces
+	CapQMP      = "qmp"       // machines can be controlled with TestCluster.QMP
+	CapUEFI     = "uefi"      // machines can boot with UEFI, see QEMUOptions.Firmware
+
+	// machines' networks can be partitioned and impaired with
+	// TestCluster.Partition and TestCluster.Impair
+	CapNetFaults = "net-faults"
 )
 
+// Capabilities lists the optional features each platform can provide.
+// Some depend on the host, see QEMUCapabilities.
+var Capabilities = map[string][]string{
+	"qemu":   {CapKVM, CapMultiNIC, CapQMP, CapUEFI, CapNetFaults},
+	"nspawn": {CapNetFaults},
+	"gce":    {CapInternet},
+	"aws":    {CapInternet},
+}
+
 type Machine interface {
 	ID() string
 	IP() string
 	PrivateIP() string
 	SSHSession() (*ssh.Session, error)
 	SSH(cmd string) ([]byte, error)
+
+	// Run runs cmd with the SSH user's shell and returns its output
+	// and exit status. opts may be nil. A non-zero exit status is
+	// not an error, only failing to run cmd is.
+	Run(cmd string, opts *RunOptions) (*RunResult, error)
+
 	Destroy() error
 	StartJournal() error
+
+	// Reboot restarts the machine and waits until it can be reached
+	// over SSH again, verifying that it really did boot again.
+	Reboot() error
+
+	// UserData returns the user data the machine was booted with,
+	// after any platform specific changes such as added SSH keys.
+	UserData() string
+
+	// ConsoleOutput returns the machine's console output as
+	// recorded by the platform.
+	ConsoleOutput() (string, error)
+
+	// CopyTo copies the file or directory at localPath to remotePath
+	// on the machine, creating any missing parent directories. A file
+	// is given mode, for a directory mode applies to remotePath itself
+	// and the permissions of its contents are preserved. Relative
+	// remote paths are relative to the home directory of the SSH user.
+	CopyTo(localPath, remotePath string, mode os.FileMode) error
+
+	// CopyFrom copies the file or directory at remotePath on the
+	// machine to localPath, preserving permissions.
+	CopyFrom(remotePath, localPath string) error
+
+	// NetworkInterfaces describes each of the machine's network
+	// interfaces, starting with the one providing PrivateIP.
+	NetworkInterfaces() []NetworkInterface
+}
+
+// Unwrap returns the platform's own machine behind m, which may be
+// wrapped by a test harness to intercept some of its methods. Wrappers
+// provide the machine they wrap with an Unwrap method.
+func Unwrap(m Machine) Machine {
+	for {
+		w, ok := m.(interface {
+			Unwrap() Machine
+		})
+		if !ok {
+			return m
+		}
+		m = w.Unwrap()
+	}
+}
+
+// NetworkInterface holds the addresses of a machine's network
+// interface. Fields the platform doesn't know are empty.
+type NetworkInterface struct {
+	HardwareAddr string
+	IPv4         string
+	IPv6         string
 }
 
 type Cluster interface {
 	NewCommand(name string, arg ...string) util.Cmd
-	NewMachine(config string) (Machine, error)
+	NewMachine(userdata *UserData) (Machine, error)
 	Machines() []Machine
 	// Points to an embedded etcd for QEMU, not sure what this
 	// is going to look like for other platforms yet.
@@ -59,9 +148,126 @@ type TestCluster struct {
 	Name        string
 	NativeFuncs []string
 	Options     map[string]string
+	Subtests    *Subtests
 	Cluster
 }
 
+// SkipError reports that a test or subtest did not run, see
+// TestCluster.Skip.
+type SkipError struct {
+	Reason string
+}
+
+func (e *SkipError) Error() string {
+	return "skipped: " + e.Reason
+}
+
+// IsSkip reports whether err is a SkipError.
+func IsSkip(err error) bool {
+	_, ok := err.(*SkipError)
+	return ok
+}
+
+// Skip returns an error that marks the test as skipped rather than
+// passed or failed. Tests should return it immediately:
+//
+//	if !supported {
+//		return c.Skip("feature not supported")
+//	}
+func (t *TestCluster) Skip(reason string) error {
+	return &SkipError{Reason: reason}
+}
+
+// Skipf is like Skip but formats its reason with fmt.Sprintf.
+func (t *TestCluster) Skipf(format string, a ...interface{}) error {
+	return t.Skip(fmt.Sprintf(format, a...))
+}
+
+// QMP returns a client for controlling m from the host through the QEMU
+// Machine Protocol. Tests using it should require CapQMP.
+func (t *TestCluster) QMP(m Machine) (*QMPClient, error) {
+	qm, ok := Unwrap(m).(*qemuMachine)
+	if !ok {
+		return nil, fmt.Errorf("machine %s does not support QMP", m.ID())
+	}
+	return qm.QMP()
+}
+
+// SubtestResult is the outcome of a subtest started by TestCluster.Run.
+type SubtestResult struct {
+	Name     string
+	Result   error
+	Duration time.Duration
+}
+
+// Subtests collects the results of subtests. It is safe for concurrent use.
+type Subtests struct {
+	mu      sync.Mutex
+	results []SubtestResult
+}
+
+func (s *Subtests) add(r SubtestResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = append(s.results, r)
+}
+
+// Results returns the results of all finished subtests in the order
+// they finished.
+func (s *Subtests) Results() []SubtestResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SubtestResult(nil), s.results...)
+}
+
+// Run runs f as a subtest called name and records its result. Much like
+// testing.T.Run the subtest's error is returned, it is up to the caller
+// to decide whether to continue with other subtests. A subtest is
+// skipped by returning the error from Skip.
+func (t *TestCluster) Run(name string, f func() error) error {
+	plog.Noticef("=== RUN %s/%s", t.Name, name)
+
+	start := time.Now()
+	err := f()
+	duration := time.Since(start)
+
+	if IsSkip(err) {
+		plog.Noticef("    --- SKIP: %s/%s (%.3fs)", t.Name, name, duration.Seconds())
+		plog.Noticef("        %v", err)
+	} else if err != nil {
+		plog.Errorf("    --- FAIL: %s/%s (%.3fs)", t.Name, name, duration.Seconds())
+		plog.Errorf("        %v", err)
+	} else {
+		plog.Noticef("    --- PASS: %s/%s (%.3fs)", t.Name, name, duration.Seconds())
+	}
+
+	if t.Subtests != nil {
+		t.Subtests.add(SubtestResult{name, err, duration})
+	}
+	return err
+}
+
+// RunNativeSubtests runs each registered NativeFunc on m as a subtest.
+// All functions are run even if some fail, the returned error
+// summarizes the failures.
+func (t *TestCluster) RunNativeSubtests(m Machine) error {
+	var failed []string
+	for _, name := range t.ListNativeFunctions() {
+		name := name
+		err := t.Run(name, func() error {
+			return t.RunNative(name, m)
+		})
+		if err != nil && !IsSkip(err) {
+			failed = append(failed, name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("native functions failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
 // run a registered NativeFunc on a remote machine
 func (t *TestCluster) RunNative(funcName string, m Machine) error {
 	// scp and execute kolet on remote machine
@@ -82,43 +288,104 @@ func (t *TestCluster) ListNativeFunctions() []string {
 
 // DropFile places file from localPath to ~/ on every machine in cluster
 func (t *TestCluster) DropFile(localPath string) error {
-	in, err := os.Open(localPath)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-
 	for _, m := range t.Machines() {
-		if _, err := in.Seek(0, 0); err != nil {
-			return err
-		}
-		if err := transfer(in, m, localPath); err != nil {
+		if err := m.CopyTo(localPath, filepath.Base(localPath), 0755); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func transfer(in io.Reader, m Machine, localPath string) error {
+// bootError annotates err, the reason machine m failed to come up, with
+// the last lines of the machine's console output if there is any.
+func bootError(m Machine, err error) error {
+	console, cerr := m.ConsoleOutput()
+	if cerr != nil {
+		plog.Infof("console output of %s unavailable: %v", m.ID(), cerr)
+		return err
+	}
+
+	console = strings.TrimRight(console, "\r\n")
+	if console == "" {
+		return err
+	}
+
+	lines := strings.Split(console, "\n")
+	if len(lines) > consoleTailLines {
+		lines = lines[len(lines)-consoleTailLines:]
+	}
+
+	return fmt.Errorf("%v\nlast %d lines of console output from %s:\n%s",
+		err, len(lines), m.ID(), strings.Join(lines, "\n"))
+}
+
+func bootID(m Machine) ([]byte, error) {
+	return m.SSH("cat /proc/sys/kernel/random/boot_id")
+}
+
+// rebootMachine implements Machine.Reboot for all platforms. reconnect
+// must replace the machine's SSH client with a new connection.
+func rebootMachine(m Machine, reconnect func() error) error {
+	reboot := func() error {
+		return startReboot(m)
+	}
+	return restartMachine(m, reboot, reconnect)
+}
+
+// startReboot asks m to reboot without waiting for it to go down.
+func startReboot(m Machine) error {
 	session, err := m.SSHSession()
 	if err != nil {
-		return fmt.Errorf("Error establishing ssh session: %v", err)
+		return fmt.Errorf("SSH session failed: %v", err)
 	}
-	defer session.Close()
-
-	session.Stdin = in
+	if err := session.Start("sudo systemctl reboot"); err != nil {
+		session.Close()
+		return fmt.Errorf("starting reboot: %v", err)
+	}
+	// Don't wait for the command to finish, the connection
+	// drops once the machine goes down.
+	go func() {
+		session.Wait()
+		session.Close()
+	}()
+	return nil
+}
 
-	// write file to fs from stdin
-	_, filename := filepath.Split(localPath)
-	err = session.Run(fmt.Sprintf("install -m 0755 /dev/stdin ./%s", filename))
+// restartMachine restarts m by calling restart and waits until
+// reconnect succeeds and the machine reports a new boot ID.
+func restartMachine(m Machine, restart, reconnect func() error) error {
+	oldID, err := bootID(m)
 	if err != nil {
+		return fmt.Errorf("reading boot ID: %v", err)
+	}
+
+	if err := restart(); err != nil {
 		return err
 	}
 
+	checker := func() error {
+		if err := reconnect(); err != nil {
+			return err
+		}
+
+		newID, err := bootID(m)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(oldID, newID) {
+			return fmt.Errorf("boot ID is unchanged, machine has not rebooted")
+		}
+		return nil
+	}
+
+	if err := util.Retry(rebootRetries, rebootDelay, checker); err != nil {
+		return bootError(m, fmt.Errorf("waiting for reboot of %s: %v", m.ID(), err))
+	}
+
 	return nil
 }
 
-func NewMachines(c Cluster, userdatas []string) ([]Machine, error) {
+func NewMachines(c Cluster, userdatas []*UserData) ([]Machine, error) {
 	var wg sync.WaitGroup
 
 	n := len(userdatas)
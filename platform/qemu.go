@@ -18,12 +18,16 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 
-	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/coreos-cloudinit/config"
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/satori/go.uuid"
 	"github.com/coreos/mantle/Godeps/_workspace/src/golang.org/x/crypto/ssh"
 	"github.com/coreos/mantle/platform/local"
@@ -32,13 +36,81 @@ import (
 
 type QEMUOptions struct {
 	DiskImage string
+
+	// Arch is the architecture of DiskImage, "amd64" (the default) or
+	// "arm64". Machines of a different architecture than the host are
+	// emulated with TCG.
+	Arch string
+
+	Memory     int      // MiB of RAM per machine, defaults to 1024
+	CPUs       int      // virtual CPUs per machine, defaults to 2
+	ExtraDisks []string // sizes of additional blank disks, e.g. "10G"
+
+	// Networks lists the bridge each of a machine's network interfaces
+	// is attached to, from br0, br1 and br2. The first interface
+	// provides the machine's IP. Defaults to just br0.
+	Networks []string
+
+	// Firmware is "bios" or "uefi" to boot machines with OVMF. It
+	// defaults to bios, except on arm64 which only boots with uefi.
+	// Each machine gets its own copy of the OVMF variable store so
+	// boot entries written by one never affect another.
+	Firmware string
+	OVMFCode string // OVMF firmware image, defaults to the arch's in qemuArches
+	OVMFVars string // OVMF variable store template, defaults to the arch's in qemuArches
+}
+
+// qemuArch describes how qemu runs machines of one architecture.
+type qemuArch struct {
+	binary    string // qemu-system-* command
+	machine   string // -machine type, empty for qemu's default
+	tcgCPU    string // -cpu when emulating, empty for qemu's default
+	netDevice string // -device for network interfaces
+	uefiOnly  bool   // the images only boot with UEFI
+	ovmfCode  string // default QEMUOptions.OVMFCode
+	ovmfVars  string // default QEMUOptions.OVMFVars
 }
 
+var qemuArches = map[string]qemuArch{
+	"amd64": {
+		binary:    "qemu-system-x86_64",
+		netDevice: "virtio-net",
+		ovmfCode:  "/usr/share/OVMF/OVMF_CODE.fd",
+		ovmfVars:  "/usr/share/OVMF/OVMF_VARS.fd",
+	},
+	"arm64": {
+		binary:    "qemu-system-aarch64",
+		machine:   "virt",
+		tcgCPU:    "cortex-a57",
+		netDevice: "virtio-net-pci",
+		uefiOnly:  true,
+		ovmfCode:  "/usr/share/AAVMF/AAVMF_CODE.fd",
+		ovmfVars:  "/usr/share/AAVMF/AAVMF_VARS.fd",
+	},
+}
+
+const (
+	defaultQEMUMemory = 1024
+	defaultQEMUCPUs   = 2
+	defaultQEMUArch   = "amd64"
+
+	// booting under emulation is much slower than with KVM
+	tcgSSHRetries = 10 * sshRetries
+)
+
+var (
+	kvmWarning     sync.Once
+	overlayWarning sync.Once
+)
+
 type qemuCluster struct {
 	mu sync.Mutex
 	*local.LocalCluster
 	machines map[string]*qemuMachine
 	conf     QEMUOptions
+	arch     qemuArch
+	kvm      bool
+	userData userData
 }
 
 type qemuMachine struct {
@@ -46,8 +118,76 @@ type qemuMachine struct {
 	id          string
 	qemu        util.Cmd
 	configDrive *local.ConfigDrive
-	netif       *local.Interface
+	ip          string             // IPv4 address of the first interface
+	netifs      []*local.Interface // guarded by qc.mu, as is tapNames
+	tapNames    []string
 	sshClient   *ssh.Client
+	userdata    string
+	consolePath string
+	qmpPath     string
+	qmpDial     sync.Mutex // serializes dialing, qemu takes one client
+	qmp         *QMPClient // set with qc.mu held
+	killed      bool
+}
+
+// QEMUCapabilities returns the capabilities of qemu machines created
+// with conf on this host. Unlike Capabilities["qemu"], CapKVM is only
+// included if KVM is usable and CapUEFI if the OVMF images exist.
+func QEMUCapabilities(conf QEMUOptions) []string {
+	if _, err := conf.setArchDefaults(); err != nil {
+		return nil
+	}
+
+	var caps []string
+	for _, c := range Capabilities["qemu"] {
+		if c == CapKVM && !conf.kvm() {
+			continue
+		}
+		if c == CapUEFI && conf.checkUEFI() != nil {
+			continue
+		}
+		caps = append(caps, c)
+	}
+	return caps
+}
+
+// setArchDefaults fills in the defaults of conf that depend on its
+// architecture and returns the architecture.
+func (conf *QEMUOptions) setArchDefaults() (qemuArch, error) {
+	if conf.Arch == "" {
+		conf.Arch = defaultQEMUArch
+	}
+	arch, ok := qemuArches[conf.Arch]
+	if !ok {
+		return arch, fmt.Errorf("unsupported qemu architecture %q", conf.Arch)
+	}
+
+	if conf.Firmware == "" && arch.uefiOnly {
+		conf.Firmware = "uefi"
+	}
+	if conf.OVMFCode == "" {
+		conf.OVMFCode = arch.ovmfCode
+	}
+	if conf.OVMFVars == "" {
+		conf.OVMFVars = arch.ovmfVars
+	}
+	return arch, nil
+}
+
+// checkUEFI returns an error if the OVMF images are missing.
+func (conf *QEMUOptions) checkUEFI() error {
+	for _, path := range []string{conf.OVMFCode, conf.OVMFVars} {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("UEFI firmware unavailable: %v", err)
+		}
+	}
+	return nil
+}
+
+// kvm reports whether machines can use KVM acceleration, which needs
+// them to match the host's architecture.
+func (conf *QEMUOptions) kvm() bool {
+	return conf.Arch == runtime.GOARCH && kvmAvailable()
 }
 
 func NewQemuCluster(conf QEMUOptions) (Cluster, error) {
@@ -56,14 +196,76 @@ func NewQemuCluster(conf QEMUOptions) (Cluster, error) {
 		return nil, err
 	}
 
+	if conf.Memory == 0 {
+		conf.Memory = defaultQEMUMemory
+	}
+	if conf.CPUs == 0 {
+		conf.CPUs = defaultQEMUCPUs
+	}
+	for _, size := range conf.ExtraDisks {
+		if _, err := parseDiskSize(size); err != nil {
+			lc.Destroy()
+			return nil, err
+		}
+	}
+
+	if len(conf.Networks) == 0 {
+		conf.Networks = []string{"br0"}
+	}
+
+	arch, err := conf.setArchDefaults()
+	if err != nil {
+		lc.Destroy()
+		return nil, err
+	}
+	switch conf.Firmware {
+	case "", "bios":
+		if arch.uefiOnly {
+			lc.Destroy()
+			return nil, fmt.Errorf("%s machines only boot with uefi firmware", conf.Arch)
+		}
+	case "uefi":
+		if err := conf.checkUEFI(); err != nil {
+			lc.Destroy()
+			return nil, err
+		}
+	default:
+		lc.Destroy()
+		return nil, fmt.Errorf("unknown firmware %q, expected bios or uefi", conf.Firmware)
+	}
+
 	qc := &qemuCluster{
 		LocalCluster: lc,
 		machines:     make(map[string]*qemuMachine),
 		conf:         conf,
+		arch:         arch,
+		kvm:          conf.kvm(),
+	}
+	for _, bridge := range conf.Networks {
+		if !qc.hasBridge(bridge) {
+			lc.Destroy()
+			return nil, fmt.Errorf("no bridge named %q", bridge)
+		}
+	}
+	if conf.Arch != runtime.GOARCH {
+		plog.Infof("emulating %s machines on a %s host with TCG", conf.Arch, runtime.GOARCH)
+	} else if !qc.kvm {
+		kvmWarning.Do(func() {
+			plog.Warningf("KVM is unavailable, falling back to much slower TCG emulation")
+		})
 	}
 	return Cluster(qc), nil
 }
 
+func (qc *qemuCluster) GetDiscoveryURL(size int) (string, error) {
+	url, err := qc.LocalCluster.GetDiscoveryURL(size)
+	if err != nil {
+		return "", err
+	}
+	qc.userData.setDiscovery(url, size)
+	return url, nil
+}
+
 func (qc *qemuCluster) Machines() []Machine {
 	machines := make([]Machine, 0, len(qc.machines))
 	qc.mu.Lock()
@@ -83,36 +285,46 @@ func (qc *qemuCluster) Destroy() error {
 	return qc.LocalCluster.Destroy()
 }
 
-func (qc *qemuCluster) NewMachine(cfg string) (Machine, error) {
+func (qc *qemuCluster) NewMachine(userdata *UserData) (Machine, error) {
 	id := uuid.NewV4()
 
-	// hacky solution for cloud config ip substitution
-	// NOTE: escaping is not supported
 	qc.mu.Lock()
-	netif := qc.Dnsmasq.GetInterface("br0")
-	ip := strings.Split(netif.DHCPv4[0].String(), "/")[0]
+	var netifs []*local.Interface
+	for _, bridge := range qc.conf.Networks {
+		netifs = append(netifs, qc.Dnsmasq.GetInterface(bridge))
+	}
+	ip := netifs[0].DHCPv4[0].IP.String()
 
-	cfg = strings.Replace(cfg, "$public_ipv4", ip, -1)
-	cfg = strings.Replace(cfg, "$private_ipv4", ip, -1)
+	running := make([]Machine, 0, len(qc.machines))
+	for _, m := range qc.machines {
+		running = append(running, m)
+	}
+	qc.mu.Unlock()
 
-	cloudConfig, err := config.NewCloudConfig(cfg)
+	cfg, info, err := qc.userData.render(userdata, ip, ip, running)
 	if err != nil {
-		qc.mu.Unlock()
 		return nil, err
 	}
 
-	if err = qc.SSHAgent.UpdateConfig(cloudConfig); err != nil {
-		qc.mu.Unlock()
+	keys, err := agentKeys(qc.SSHAgent)
+	if err != nil {
 		return nil, err
 	}
-
-	if cloudConfig.Hostname == "" {
-		cloudConfig.Hostname = id.String()[:8]
+	cfg, injected, err := injectSSHKeys(userdata, cfg, keys, "")
+	if err != nil {
+		return nil, err
 	}
 
-	qc.mu.Unlock()
-
-	configDrive, err := local.NewConfigDrive(cloudConfig)
+	// the config drive's metadata carries the keys when the user data
+	// can't, and a hostname when the user data doesn't set one
+	meta := local.ConfigDriveMetadata{
+		UUID:     id.String(),
+		Hostname: id.String()[:8],
+	}
+	if !injected {
+		meta.SSHKeys = keys
+	}
+	configDrive, err := local.NewConfigDrive(cfg, meta)
 	if err != nil {
 		return nil, err
 	}
@@ -121,51 +333,140 @@ func (qc *qemuCluster) NewMachine(cfg string) (Machine, error) {
 		qc:          qc,
 		id:          id.String(),
 		configDrive: configDrive,
-		netif:       netif,
+		ip:          ip,
+		netifs:      netifs,
+		userdata:    cfg,
 	}
 
-	disk, err := setupDisk(qc.conf.DiskImage)
+	// once qemu is running Destroy cleans up after any failure
+	started := false
+	defer func() {
+		if started {
+			return
+		}
+		qm.configDrive.Destroy()
+		if qm.consolePath != "" {
+			os.Remove(qm.consolePath)
+		}
+	}()
+
+	disk, diskFormat, err := setupDisk(qc.conf.DiskImage)
 	if err != nil {
 		return nil, err
 	}
 	defer disk.Close()
 
-	qc.mu.Lock()
+	var extraDisks []*os.File
+	defer func() {
+		for _, f := range extraDisks {
+			f.Close()
+		}
+	}()
+	for _, size := range qc.conf.ExtraDisks {
+		f, err := blankDisk(size)
+		if err != nil {
+			return nil, err
+		}
+		extraDisks = append(extraDisks, f)
+	}
 
-	tap, err := qc.NewTap("br0")
+	// the variable store is writable so it's copied like a disk
+	var varStore *os.File
+	if qc.conf.Firmware == "uefi" {
+		varStore, err = copyDisk(qc.conf.OVMFVars)
+		if err != nil {
+			return nil, err
+		}
+		defer varStore.Close()
+	}
+
+	console, err := ioutil.TempFile("", "mantle-qemu-console")
 	if err != nil {
-		qc.mu.Unlock()
 		return nil, err
 	}
-	defer tap.Close()
+	qm.consolePath = console.Name()
+	console.Close()
+	qm.qmpPath = qm.consolePath + ".qmp"
 
-	qmMac := qm.netif.HardwareAddr.String()
 	qmCfg := qm.configDrive.Directory
-	qm.qemu = qm.qc.NewCommand(
-		"qemu-system-x86_64",
-		"-machine", "accel=kvm",
-		"-cpu", "host",
-		"-smp", "2",
-		"-m", "1024",
+	machine := "accel=tcg"
+	if qc.kvm {
+		machine = "accel=kvm"
+	}
+	if qc.arch.machine != "" {
+		machine = qc.arch.machine + "," + machine
+	}
+	qemuArgs := []string{"-machine", machine}
+	if qc.kvm {
+		qemuArgs = append(qemuArgs, "-cpu", "host")
+	} else if qc.arch.tcgCPU != "" {
+		qemuArgs = append(qemuArgs, "-cpu", qc.arch.tcgCPU)
+	}
+	qemuArgs = append(qemuArgs,
+		"-smp", strconv.Itoa(qc.conf.CPUs),
+		"-m", strconv.Itoa(qc.conf.Memory),
 		"-uuid", qm.id,
 		"-display", "none",
-		"-add-fd", "fd=3,set=1",
-		"-drive", "file=/dev/fdset/1,media=disk,if=virtio,format=raw",
-		"-netdev", "tap,id=tap,fd=4",
-		"-device", "virtio-net,netdev=tap,mac="+qmMac,
+		"-serial", "file:"+qm.consolePath,
+		"-qmp", "unix:"+qm.qmpPath+",server,nowait")
+
+	// disks and taps are passed to qemu as extra files, starting at fd=3
+	var extraFiles []*os.File
+	addFile := func(f *os.File) int {
+		extraFiles = append(extraFiles, f)
+		return 2 + len(extraFiles)
+	}
+
+	for i, f := range append([]*os.File{disk}, extraDisks...) {
+		format := "raw"
+		if i == 0 {
+			format = diskFormat
+		}
+		qemuArgs = append(qemuArgs,
+			"-add-fd", fmt.Sprintf("fd=%d,set=%d", addFile(f), 1+i),
+			"-drive", fmt.Sprintf("file=/dev/fdset/%d,media=disk,if=virtio,format=%s", 1+i, format))
+	}
+
+	if varStore != nil {
+		set := 2 + len(extraDisks)
+		qemuArgs = append(qemuArgs,
+			"-drive", "if=pflash,unit=0,format=raw,readonly=on,file="+qc.conf.OVMFCode,
+			"-add-fd", fmt.Sprintf("fd=%d,set=%d", addFile(varStore), set),
+			"-drive", fmt.Sprintf("if=pflash,unit=1,format=raw,file=/dev/fdset/%d", set))
+	}
+
+	qc.mu.Lock()
+
+	for i, netif := range qm.netifs {
+		tap, err := qc.NewTap(qc.conf.Networks[i])
+		if err != nil {
+			qc.mu.Unlock()
+			return nil, err
+		}
+		defer tap.Close()
+		qm.tapNames = append(qm.tapNames, tap.Attrs().Name)
+
+		qemuArgs = append(qemuArgs,
+			"-netdev", fmt.Sprintf("tap,id=tap%d,fd=%d", i, addFile(tap.File)),
+			"-device", fmt.Sprintf("%s,netdev=tap%d,mac=%s", qc.arch.netDevice, i, netif.HardwareAddr))
+	}
+
+	qemuArgs = append(qemuArgs,
 		"-fsdev", "local,id=cfg,security_model=none,readonly,path="+qmCfg,
 		"-device", "virtio-9p-pci,fsdev=cfg,mount_tag=config-2")
 
+	qm.qemu = qm.qc.NewCommand(qc.arch.binary, qemuArgs...)
+
 	qc.mu.Unlock()
 
 	cmd := qm.qemu.(*local.NsCmd)
 	cmd.Stderr = os.Stderr
-	cmd.ExtraFiles = append(cmd.ExtraFiles, disk)     // fd=3
-	cmd.ExtraFiles = append(cmd.ExtraFiles, tap.File) // fd=4
+	cmd.ExtraFiles = append(cmd.ExtraFiles, extraFiles...)
 
 	if err = qm.qemu.Start(); err != nil {
 		return nil, err
 	}
+	started = true
 
 	// Allow a few authentication failures in case setup is slow.
 	sshchecker := func() error {
@@ -178,11 +479,12 @@ func (qc *qemuCluster) NewMachine(cfg string) (Machine, error) {
 		return nil
 	}
 
-	if err := util.Retry(sshRetries, sshTimeout, sshchecker); err != nil {
-		return nil, err
+	retries := sshRetries
+	if !qc.kvm {
+		retries = tcgSSHRetries
 	}
-
-	if err != nil {
+	if err := util.Retry(retries, sshTimeout, sshchecker); err != nil {
+		err = bootError(qm, err)
 		qm.Destroy()
 		return nil, err
 	}
@@ -202,12 +504,63 @@ func (qc *qemuCluster) NewMachine(cfg string) (Machine, error) {
 	qc.machines[qm.ID()] = qm
 	qc.mu.Unlock()
 
+	qc.userData.added(qm.ID(), info)
+
 	return Machine(qm), nil
 }
 
+// setupDisk creates a disk for a new machine from the base image,
+// returning it along with its format. A qcow2 overlay backed by the
+// image is used if possible, since creating it is nearly free, with a
+// full copy of the image as the fallback.
+func setupDisk(imageFile string) (*os.File, string, error) {
+	disk, err := overlayDisk(imageFile)
+	if err == nil {
+		return disk, "qcow2", nil
+	}
+
+	overlayWarning.Do(func() {
+		plog.Warningf("creating qcow2 overlay failed, copying disk images instead: %v", err)
+	})
+	disk, err = copyDisk(imageFile)
+	return disk, "raw", err
+}
+
+// Create a new nameless qcow2 overlay backed by the base image. The
+// base image is only ever opened read-only by qemu so it can be shared
+// by any number of machines.
+func overlayDisk(imageFile string) (*os.File, error) {
+	backing, err := filepath.Abs(imageFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(backing); err != nil {
+		return nil, err
+	}
+
+	dstFile, err := ioutil.TempFile("", "mantle-qemu")
+	if err != nil {
+		return nil, err
+	}
+	dstFileName := dstFile.Name()
+	defer os.Remove(dstFileName)
+	dstFile.Close()
+
+	var stderr bytes.Buffer
+	qemuImg := exec.Command("qemu-img", "create", "-q", "-f", "qcow2",
+		"-b", backing, "-F", "raw", dstFileName)
+	qemuImg.Stderr = &stderr
+
+	if err := qemuImg.Run(); err != nil {
+		return nil, fmt.Errorf("qemu-img: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return os.OpenFile(dstFileName, os.O_RDWR, 0)
+}
+
 // Copy the base image to a new nameless temporary file.
 // cp is used since it supports sparse and reflink.
-func setupDisk(imageFile string) (*os.File, error) {
+func copyDisk(imageFile string) (*os.File, error) {
 	dstFile, err := ioutil.TempFile("", "mantle-qemu")
 	if err != nil {
 		return nil, err
@@ -229,16 +582,124 @@ func setupDisk(imageFile string) (*os.File, error) {
 	return os.OpenFile(dstFileName, os.O_RDWR, 0)
 }
 
+func (qc *qemuCluster) hasBridge(bridge string) bool {
+	for _, seg := range qc.Dnsmasq.Segments {
+		if seg.BridgeName == bridge {
+			return true
+		}
+	}
+	return false
+}
+
+// Create a sparse nameless temporary file of the given size.
+func blankDisk(size string) (*os.File, error) {
+	n, err := parseDiskSize(size)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "mantle-qemu-disk")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+
+	if err := f.Truncate(n); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseDiskSize parses sizes such as "512M" or "10G" to bytes. Suffixes
+// are powers of 1024 as in qemu-img, a plain number is in bytes.
+func parseDiskSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	var shift uint
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		case 'T':
+			shift = 40
+		}
+		if shift != 0 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid disk size %q", size)
+	}
+	return n << shift, nil
+}
+
+// kvmAvailable reports whether qemu can use KVM acceleration.
+func kvmAvailable() bool {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
 func (m *qemuMachine) ID() string {
 	return m.id
 }
 
 func (m *qemuMachine) IP() string {
-	return m.netif.DHCPv4[0].IP.String()
+	return m.ip
 }
 
 func (m *qemuMachine) PrivateIP() string {
-	return m.netif.DHCPv4[0].IP.String()
+	return m.ip
+}
+
+func (qm *qemuMachine) localCluster() *local.LocalCluster {
+	return qm.qc.LocalCluster
+}
+
+func (qm *qemuMachine) taps() []string {
+	qm.qc.mu.Lock()
+	defer qm.qc.mu.Unlock()
+	return append([]string(nil), qm.tapNames...)
+}
+
+func (qm *qemuMachine) addrs() []net.IP {
+	qm.qc.mu.Lock()
+	defer qm.qc.mu.Unlock()
+
+	var addrs []net.IP
+	for _, netif := range qm.netifs {
+		for _, a := range netif.DHCPv4 {
+			addrs = append(addrs, a.IP)
+		}
+		for _, a := range netif.DHCPv6 {
+			addrs = append(addrs, a.IP)
+		}
+	}
+	return addrs
+}
+
+func (qm *qemuMachine) NetworkInterfaces() []NetworkInterface {
+	qm.qc.mu.Lock()
+	defer qm.qc.mu.Unlock()
+
+	var nics []NetworkInterface
+	for _, netif := range qm.netifs {
+		nics = append(nics, NetworkInterface{
+			HardwareAddr: netif.HardwareAddr.String(),
+			IPv4:         netif.DHCPv4[0].IP.String(),
+			IPv6:         netif.DHCPv6[0].IP.String(),
+		})
+	}
+	return nics
 }
 
 func (qm *qemuMachine) SSHSession() (*ssh.Session, error) {
@@ -279,11 +740,95 @@ func (qm *qemuMachine) StartJournal() error {
 	return nil
 }
 
+func (qm *qemuMachine) Run(cmd string, opts *RunOptions) (*RunResult, error) {
+	return runCommand(qm, cmd, opts)
+}
+
+func (qm *qemuMachine) CopyTo(localPath, remotePath string, mode os.FileMode) error {
+	return copyTo(qm, localPath, remotePath, mode)
+}
+
+func (qm *qemuMachine) CopyFrom(remotePath, localPath string) error {
+	return copyFrom(qm, remotePath, localPath)
+}
+
+func (qm *qemuMachine) Reboot() error {
+	return rebootMachine(qm, qm.reconnect)
+}
+
+// reconnect replaces the machine's SSH client after it restarts.
+func (qm *qemuMachine) reconnect() error {
+	qm.qc.mu.Lock()
+	defer qm.qc.mu.Unlock()
+	client, err := qm.qc.SSHAgent.NewClient(qm.IP())
+	if err != nil {
+		return err
+	}
+	qm.sshClient.Close()
+	qm.sshClient = client
+	return nil
+}
+
+// QMP returns a client for the machine's QMP socket, connecting to it
+// the first time. Dialing may retry for a while so it is done without
+// holding the cluster lock.
+func (qm *qemuMachine) QMP() (*QMPClient, error) {
+	qm.qmpDial.Lock()
+	defer qm.qmpDial.Unlock()
+
+	qm.qc.mu.Lock()
+	qmp := qm.qmp
+	qm.qc.mu.Unlock()
+	if qmp != nil {
+		return qmp, nil
+	}
+
+	conn, err := dialQMP(qm.qmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to QMP socket of %s: %v", qm.ID(), err)
+	}
+
+	qmp = &QMPClient{conn: conn, qm: qm}
+	qm.qc.mu.Lock()
+	qm.qmp = qmp
+	qm.qc.mu.Unlock()
+	return qmp, nil
+}
+
+// kill stops qemu at once, see QMPClient.Crash.
+func (qm *qemuMachine) kill() error {
+	qm.qc.mu.Lock()
+	defer qm.qc.mu.Unlock()
+	if qm.killed {
+		return nil
+	}
+	qm.killed = true
+	return qm.qemu.Kill()
+}
+
+func (qm *qemuMachine) UserData() string {
+	return qm.userdata
+}
+
+// ConsoleOutput returns everything written to the machine's first
+// serial port so far.
+func (qm *qemuMachine) ConsoleOutput() (string, error) {
+	b, err := ioutil.ReadFile(qm.consolePath)
+	return string(b), err
+}
+
 func (qm *qemuMachine) destroy(locked bool) error {
 	if qm.sshClient != nil {
 		qm.sshClient.Close()
 	}
-	err := qm.qemu.Kill()
+	if qm.qmp != nil {
+		qm.qmp.conn.close()
+	}
+
+	var err error
+	if !qm.killed {
+		err = qm.qemu.Kill()
+	}
 
 	if qm.configDrive != nil {
 		err2 := qm.configDrive.Destroy()
@@ -292,6 +837,11 @@ func (qm *qemuMachine) destroy(locked bool) error {
 		}
 	}
 
+	if qm.consolePath != "" {
+		os.Remove(qm.consolePath)
+		os.Remove(qm.qmpPath)
+	}
+
 	// ugh.
 	if !locked {
 		qm.qc.mu.Lock()
@@ -0,0 +1,87 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestParseDiskSize(t *testing.T) {
+	for _, tt := range []struct {
+		in  string
+		out int64
+		ok  bool
+	}{
+		{"4096", 4096, true},
+		{"512K", 512 << 10, true},
+		{"10m", 10 << 20, true},
+		{"1G", 1 << 30, true},
+		{"2T", 2 << 40, true},
+		{"", 0, false},
+		{"G", 0, false},
+		{"0", 0, false},
+		{"-1G", 0, false},
+		{"1.5G", 0, false},
+		{"10X", 0, false},
+		{"8388607T", 8388607 << 40, true},
+		{"8388608T", 0, false},
+		{"99999999999T", 0, false},
+	} {
+		out, err := parseDiskSize(tt.in)
+		if tt.ok && err != nil {
+			t.Errorf("parseDiskSize(%q): unexpected error: %v", tt.in, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("parseDiskSize(%q): expected an error, got %d", tt.in, out)
+		} else if out != tt.out {
+			t.Errorf("parseDiskSize(%q) = %d, want %d", tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestOverlayDisk(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip(err)
+	}
+
+	base, err := ioutil.TempFile("", "mantle-qemu-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(base.Name())
+	if err := base.Truncate(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	base.Close()
+
+	disk, format, err := setupDisk(base.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	if format != "qcow2" {
+		t.Errorf("got a %s disk, want qcow2", format)
+	}
+
+	magic := make([]byte, 4)
+	if _, err := disk.ReadAt(magic, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(magic) != "QFI\xfb" {
+		t.Errorf("disk is not a qcow2 image, starts with %q", magic)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/mantle/util"
+)
+
+// qmpConn speaks the QEMU Machine Protocol over a qemu -qmp socket.
+type qmpConn struct {
+	conn *net.UnixConn
+	dec  *json.Decoder
+}
+
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+	Event string `json:"event"`
+}
+
+// dialQMP connects to the QMP socket at path and leaves capabilities
+// negotiation mode so commands can be run.
+func dialQMP(path string) (*qmpConn, error) {
+	var conn *net.UnixConn
+	dial := func() (err error) {
+		conn, err = net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+		return
+	}
+	// qemu may not have created the socket yet
+	if err := util.Retry(10, 500*time.Millisecond, dial); err != nil {
+		return nil, err
+	}
+
+	c := &qmpConn{conn: conn, dec: json.NewDecoder(conn)}
+
+	var greeting struct {
+		QMP json.RawMessage
+	}
+	if err := c.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading QMP greeting: %v", err)
+	}
+	if greeting.QMP == nil {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected QMP greeting")
+	}
+
+	if _, err := c.execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// execute runs cmd and returns its result. If f is not nil its file
+// descriptor is passed to qemu along with the command, as the getfd
+// and add-fd commands require.
+func (c *qmpConn) execute(cmd string, args interface{}, f *os.File) (json.RawMessage, error) {
+	req, err := json.Marshal(struct {
+		Execute   string      `json:"execute"`
+		Arguments interface{} `json:"arguments,omitempty"`
+	}{cmd, args})
+	if err != nil {
+		return nil, err
+	}
+
+	var oob []byte
+	if f != nil {
+		oob = syscall.UnixRights(int(f.Fd()))
+	}
+	if _, _, err := c.conn.WriteMsgUnix(req, oob, nil); err != nil {
+		return nil, fmt.Errorf("QMP %s: %v", cmd, err)
+	}
+
+	for {
+		var resp qmpResponse
+		if err := c.dec.Decode(&resp); err != nil {
+			return nil, fmt.Errorf("QMP %s: %v", cmd, err)
+		}
+		if resp.Event != "" {
+			plog.Debugf("QMP event %s", resp.Event)
+			continue
+		}
+		if resp.Error != nil {
+			return nil, fmt.Errorf("QMP %s: %s: %s", cmd, resp.Error.Class, resp.Error.Desc)
+		}
+		return resp.Return, nil
+	}
+}
+
+func (c *qmpConn) close() error {
+	return c.conn.Close()
+}
+
+// QMPClient controls a qemu machine from the host, see TestCluster.QMP.
+type QMPClient struct {
+	mu      sync.Mutex
+	conn    *qmpConn
+	qm      *qemuMachine
+	devices int // hot-plugged so far, used to name new ones
+}
+
+// Execute runs an arbitrary QMP command, returning the raw JSON result.
+func (c *QMPClient) Execute(cmd string, args interface{}) (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.execute(cmd, args, nil)
+}
+
+// Pause stops the machine's CPUs until Resume is called.
+func (c *QMPClient) Pause() error {
+	_, err := c.Execute("stop", nil)
+	return err
+}
+
+// Resume continues running a paused machine.
+func (c *QMPClient) Resume() error {
+	_, err := c.Execute("cont", nil)
+	return err
+}
+
+// PowerCycle resets the machine as if its power had been cut and
+// restored, without giving it a chance to shut down, and waits until
+// it has booted again.
+func (c *QMPClient) PowerCycle() error {
+	reset := func() error {
+		_, err := c.Execute("system_reset", nil)
+		return err
+	}
+	return restartMachine(c.qm, reset, c.qm.reconnect)
+}
+
+// Crash simulates the machine's host crashing by killing qemu at once.
+// Anything qemu had not yet written to disk is lost and the machine
+// can't be used again afterwards.
+func (c *QMPClient) Crash() error {
+	return c.qm.kill()
+}
+
+// AddDisk hot-plugs a blank virtio disk of the given size, e.g. "10G".
+func (c *QMPClient) AddDisk(size string) error {
+	f, err := blankDisk(size)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res, err := c.conn.execute("add-fd", nil, f)
+	if err != nil {
+		return err
+	}
+	var fdinfo struct {
+		FdsetID int `json:"fdset-id"`
+	}
+	if err := json.Unmarshal(res, &fdinfo); err != nil {
+		return err
+	}
+
+	// drive_add has no QMP equivalent that is stable across versions
+	c.devices++
+	id := fmt.Sprintf("hotplug%d", c.devices)
+	res, err = c.conn.execute("human-monitor-command", map[string]string{
+		"command-line": fmt.Sprintf("drive_add 0 file=/dev/fdset/%d,if=none,id=%s,format=raw",
+			fdinfo.FdsetID, id),
+	}, nil)
+	if err != nil {
+		return err
+	}
+	var out string
+	if err := json.Unmarshal(res, &out); err != nil {
+		return err
+	}
+	if out = strings.TrimSpace(out); out != "OK" {
+		return fmt.Errorf("drive_add: %s", out)
+	}
+
+	if _, err := c.conn.execute("device_add", map[string]string{
+		"driver": "virtio-blk-pci",
+		"drive":  id,
+		"id":     id + "-dev",
+	}, nil); err != nil {
+		c.conn.execute("human-monitor-command", map[string]string{
+			"command-line": "drive_del " + id,
+		}, nil)
+		return err
+	}
+	return nil
+}
+
+// AddNIC hot-plugs a virtio network interface attached to bridge,
+// returning the IPv4 address it will be assigned by DHCP. The new
+// interface is included in the machine's NetworkInterfaces.
+func (c *QMPClient) AddNIC(bridge string) (string, error) {
+	qc := c.qm.qc
+	qc.mu.Lock()
+	if !qc.hasBridge(bridge) {
+		qc.mu.Unlock()
+		return "", fmt.Errorf("no bridge named %q", bridge)
+	}
+	netif := qc.Dnsmasq.GetInterface(bridge)
+	tap, err := qc.NewTap(bridge)
+	qc.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	defer tap.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.devices++
+	id := fmt.Sprintf("hotplug%d", c.devices)
+	if _, err := c.conn.execute("getfd", map[string]string{"fdname": id}, tap.File); err != nil {
+		return "", err
+	}
+	if _, err := c.conn.execute("netdev_add", map[string]string{
+		"type": "tap",
+		"id":   id,
+		"fd":   id,
+	}, nil); err != nil {
+		return "", err
+	}
+	if _, err := c.conn.execute("device_add", map[string]string{
+		"driver": "virtio-net-pci",
+		"netdev": id,
+		"mac":    netif.HardwareAddr.String(),
+		"id":     id + "-dev",
+	}, nil); err != nil {
+		c.conn.execute("netdev_del", map[string]string{"id": id}, nil)
+		return "", err
+	}
+
+	// only now does the machine really have the interface
+	qc.mu.Lock()
+	c.qm.netifs = append(c.qm.netifs, netif)
+	c.qm.tapNames = append(c.qm.tapNames, tap.Attrs().Name)
+	qc.mu.Unlock()
+
+	return netif.DHCPv4[0].IP.String(), nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeQMP answers QMP commands on a unix socket with canned replies.
+func fakeQMP(t *testing.T, path string, replies map[string]string) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		w := bufio.NewWriter(conn)
+		w.WriteString(`{"QMP": {"version": {}, "capabilities": []}}` + "\r\n")
+		w.Flush()
+
+		dec := json.NewDecoder(conn)
+		for {
+			var req struct {
+				Execute string
+			}
+			if err := dec.Decode(&req); err != nil {
+				return
+			}
+			// events may arrive before any reply
+			w.WriteString(`{"event": "RESUME", "timestamp": {}}` + "\r\n")
+			reply, ok := replies[req.Execute]
+			if !ok {
+				reply = `{"error": {"class": "CommandNotFound", "desc": "unknown"}}`
+			}
+			w.WriteString(reply + "\r\n")
+			w.Flush()
+		}
+	}()
+}
+
+func TestQMP(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "mantle-qmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "qmp")
+	fakeQMP(t, path, map[string]string{
+		"qmp_capabilities": `{"return": {}}`,
+		"query-status":     `{"return": {"status": "running", "running": true}}`,
+	})
+
+	c, err := dialQMP(path)
+	if err != nil {
+		t.Fatalf("dialQMP: %v", err)
+	}
+	defer c.close()
+
+	res, err := c.execute("query-status", nil, nil)
+	if err != nil {
+		t.Fatalf("query-status: %v", err)
+	}
+	var status struct {
+		Status string
+	}
+	if err := json.Unmarshal(res, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != "running" {
+		t.Errorf("got status %q, want running", status.Status)
+	}
+
+	if _, err := c.execute("bogus", nil, nil); err == nil {
+		t.Errorf("expected an error for an unknown command")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/coreos/mantle/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+)
+
+// RunOptions changes how Machine.Run runs a command. The zero value,
+// like nil, runs it without input, with the SSH user's environment and
+// without a time limit.
+type RunOptions struct {
+	Stdin io.Reader
+
+	// Env holds variables exported to the command, in addition to
+	// those of the SSH user's login environment.
+	Env map[string]string
+
+	// Timeout limits how long Run waits for the command. The command
+	// is sent SIGKILL when it expires, though sshd may not pass it on.
+	Timeout time.Duration
+}
+
+// RunResult is the outcome of a command run with Machine.Run.
+type RunResult struct {
+	Stdout     []byte
+	Stderr     []byte
+	ExitStatus int
+	Signal     string // set if the command was killed by a signal
+	Duration   time.Duration
+}
+
+// Success reports whether the command exited with status 0.
+func (r *RunResult) Success() bool {
+	return r.ExitStatus == 0 && r.Signal == ""
+}
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// runCommand implements Machine.Run for all platforms. Only failing to
+// run cmd is an error, its exit status is reported in the result.
+func runCommand(m Machine, cmd string, opts *RunOptions) (*RunResult, error) {
+	if opts == nil {
+		opts = &RunOptions{}
+	}
+
+	// sshd only accepts a few variables from clients so set them in
+	// the command itself
+	if len(opts.Env) > 0 {
+		var names []string
+		for name := range opts.Env {
+			if !envName.MatchString(name) {
+				return nil, fmt.Errorf("invalid environment variable name %q", name)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var prefix string
+		for _, name := range names {
+			prefix += fmt.Sprintf("export %s=%s; ", name, shellQuote(opts.Env[name]))
+		}
+		cmd = prefix + cmd
+	}
+
+	session, err := m.SSHSession()
+	if err != nil {
+		return nil, fmt.Errorf("SSH session failed: %v", err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdin = opts.Stdin
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	start := time.Now()
+	if err := session.Start(cmd); err != nil {
+		return nil, fmt.Errorf("starting %q on %s: %v", cmd, m.ID(), err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if opts.Timeout > 0 {
+		timeout = time.After(opts.Timeout)
+	}
+
+	select {
+	case err = <-done:
+	case <-timeout:
+		session.Signal(ssh.SIGKILL)
+		return nil, fmt.Errorf("%q on %s timed out after %v", cmd, m.ID(), opts.Timeout)
+	}
+
+	res := &RunResult{
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.Bytes(),
+		Duration: time.Since(start),
+	}
+	if exit, ok := err.(*ssh.ExitError); ok {
+		res.ExitStatus = exit.ExitStatus()
+		res.Signal = exit.Signal()
+	} else if err != nil {
+		return nil, fmt.Errorf("running %q on %s: %v", cmd, m.ID(), err)
+	}
+	return res, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	fc := NewFakeCluster()
+	defer fc.Destroy()
+
+	m, err := fc.NewMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc.Handle("false", FakeResponse{Stdout: "out\n", Stderr: "err\n", ExitStatus: 1})
+	fc.HandleFunc(`export A='x y'; export B='it'\\''s'; cat`, func(m *FakeMachine, cmd string) FakeResponse {
+		return FakeResponse{Stdout: "ok"}
+	})
+	fc.HandleFunc("sleep .*", func(m *FakeMachine, cmd string) FakeResponse {
+		time.Sleep(time.Second)
+		return FakeResponse{}
+	})
+
+	res, err := m.Run("false", nil)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if string(res.Stdout) != "out\n" || string(res.Stderr) != "err\n" || res.ExitStatus != 1 || res.Success() {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	res, err = m.Run("cat", &RunOptions{
+		Stdin: strings.NewReader("input"),
+		Env:   map[string]string{"B": "it's", "A": "x y"},
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !res.Success() || string(res.Stdout) != "ok" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	cmds := fc.Commands()
+	if stdin := cmds[len(cmds)-1].Stdin; stdin != "input" {
+		t.Errorf("command got stdin %q, want %q", stdin, "input")
+	}
+
+	if _, err := m.Run("true", &RunOptions{Env: map[string]string{"A=B": ""}}); err == nil {
+		t.Errorf("Run: expected an error for an invalid variable name")
+	}
+
+	if _, err := m.Run("sleep 1", &RunOptions{Timeout: 50 * time.Millisecond}); err == nil {
+		t.Errorf("Run: expected a timeout")
+	}
+
+	m.(*FakeMachine).FailSSH(errors.New("connection refused"))
+	if _, err := m.Run("true", nil); err == nil {
+		t.Errorf("Run: expected an error for an unreachable machine")
+	}
+}
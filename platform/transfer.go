@@ -0,0 +1,247 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Files are moved between the local host and machines as tar streams
+// over an SSH session, so anything from a single file to a directory
+// tree of any size can be copied without buffering it in memory.
+
+// shellQuote quotes s for use as a single word in a POSIX shell command.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// copyTo implements Machine.CopyTo for all platforms.
+func copyTo(m Machine, localPath, remotePath string, mode os.FileMode) error {
+	session, err := m.SSHSession()
+	if err != nil {
+		return fmt.Errorf("SSH session failed: %v", err)
+	}
+	defer session.Close()
+
+	pr, pw := io.Pipe()
+	var stderr bytes.Buffer
+	session.Stdin = pr
+	session.Stderr = &stderr
+
+	go func() {
+		pw.CloseWithError(writeTar(pw, localPath, path.Base(remotePath), mode))
+	}()
+
+	dir := path.Dir(remotePath)
+	cmd := fmt.Sprintf("mkdir -p %s && tar -x -p -C %s", shellQuote(dir), shellQuote(dir))
+	if err := session.Run(cmd); err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("copying %s to %s:%s failed: %v: %s",
+			localPath, m.ID(), remotePath, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// copyFrom implements Machine.CopyFrom for all platforms.
+func copyFrom(m Machine, remotePath, localPath string) error {
+	session, err := m.SSHSession()
+	if err != nil {
+		return fmt.Errorf("SSH session failed: %v", err)
+	}
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	cmd := fmt.Sprintf("tar -c -C %s %s", shellQuote(path.Dir(remotePath)),
+		shellQuote(path.Base(remotePath)))
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+
+	if err := extractTar(stdout, path.Base(remotePath), localPath); err != nil {
+		return fmt.Errorf("copying %s:%s to %s failed: %v", m.ID(), remotePath, localPath, err)
+	}
+
+	if err := session.Wait(); err != nil {
+		return fmt.Errorf("copying %s:%s to %s failed: %v: %s", m.ID(), remotePath,
+			localPath, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// writeTar writes a tar archive of localPath to w with localPath itself
+// renamed to name. If localPath is a regular file it is given mode,
+// if it is a directory mode applies to the top directory and the
+// permissions of its contents are preserved.
+func writeTar(w io.Writer, localPath, name string, mode os.FileMode) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(localPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(name, filepath.ToSlash(rel))
+		if rel == "." {
+			hdr.Name = name
+			hdr.Mode = int64(mode.Perm())
+		}
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.Uid, hdr.Gid = 0, 0
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// extractTar extracts the archive in r to localPath, renaming the
+// archive's top level entry name to localPath.
+func extractTar(r io.Reader, name, localPath string) error {
+	// symlinks are created last so no entry is written through one
+	type symlink struct{ target, dst string }
+	var symlinks []symlink
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		rel := strings.TrimSuffix(hdr.Name, "/")
+		if rel != name && !strings.HasPrefix(rel, name+"/") {
+			return fmt.Errorf("unexpected entry %q in archive", hdr.Name)
+		}
+		rel = strings.TrimPrefix(rel, name)
+		if strings.Contains(rel+"/", "/../") {
+			return fmt.Errorf("refusing to extract %q", hdr.Name)
+		}
+		dst := filepath.Join(localPath, filepath.FromSlash(rel))
+		mode := os.FileMode(hdr.Mode).Perm()
+		if rel != "" {
+			if err := checkWithin(localPath, filepath.Dir(dst)); err != nil {
+				return fmt.Errorf("refusing to extract %q: %v", hdr.Name, err)
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			symlinks = append(symlinks, symlink{hdr.Linkname, dst})
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			plog.Infof("not extracting %q, unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	for _, l := range symlinks {
+		// an earlier symlink may be a parent of this one
+		if l.dst != localPath {
+			if err := checkWithin(localPath, filepath.Dir(l.dst)); err != nil {
+				return fmt.Errorf("refusing to create symlink %q: %v", l.dst, err)
+			}
+		}
+		if err := os.Symlink(l.target, l.dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWithin returns an error if dir, with any symlinks resolved, is
+// not root or a directory inside it.
+func checkWithin(root, dir string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(realRoot, realDir)
+	if err != nil {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside %s", dir, root)
+	}
+	return nil
+}
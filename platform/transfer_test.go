@@ -0,0 +1,180 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarRoundTrip(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "mantle-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	files := map[string]struct {
+		data string
+		mode os.FileMode
+	}{
+		"a":     {"hello\n", 0644},
+		"b/c":   {"", 0600},
+		"b/d/e": {"#!/bin/sh\n", 0755},
+	}
+	for name, f := range files {
+		p := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(f.data), f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeTar(&buf, src, "remote", 0700); err != nil {
+		t.Fatalf("writeTar: %v", err)
+	}
+	dst := filepath.Join(tmp, "dst")
+	if err := extractTar(&buf, "remote", dst); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("top directory has mode %v, want %v", info.Mode().Perm(), os.FileMode(0700))
+	}
+	for name, f := range files {
+		p := filepath.Join(dst, name)
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if string(data) != f.data {
+			t.Errorf("%s: got %q, want %q", name, data, f.data)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != f.mode {
+			t.Errorf("%s: got mode %v, want %v", name, info.Mode().Perm(), f.mode)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "link")); err != nil || link != "a" {
+		t.Errorf("link: got %q, %v, want %q", link, err, "a")
+	}
+}
+
+func TestTarSingleFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "mantle-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "kolet")
+	if err := ioutil.WriteFile(src, []byte("binary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeTar(&buf, src, "kolet", 0755); err != nil {
+		t.Fatalf("writeTar: %v", err)
+	}
+	dst := filepath.Join(tmp, "copy")
+	if err := extractTar(&buf, "kolet", dst); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("got mode %v, want %v", info.Mode().Perm(), os.FileMode(0755))
+	}
+}
+
+func TestExtractTarRejectsOtherEntries(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "mantle-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "f")
+	if err := ioutil.WriteFile(src, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeTar(&buf, src, "../f", 0644); err != nil {
+		t.Fatalf("writeTar: %v", err)
+	}
+	if err := extractTar(&buf, "f", filepath.Join(tmp, "dst")); err == nil {
+		t.Errorf("extractTar accepted an entry outside the requested path")
+	}
+}
+
+func TestExtractTarSymlinkEscape(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "mantle-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	outside := filepath.Join(tmp, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// d/link points outside the destination and d/link/evil would
+	// be written through it
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "d/link", Typeflag: tar.TypeSymlink, Linkname: outside},
+		{Name: "d/link/evil", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := extractTar(&buf, "d", filepath.Join(tmp, "dst")); err == nil {
+		t.Errorf("extractTar accepted an entry inside a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+		t.Errorf("file was written outside the destination: %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/mantle/network"
+)
+
+// Cloud configs and scripts passed to Cluster.NewMachine are
+// text/templates, expanded with UserDataParams for the new machine on
+// every platform. For example:
+//
+//	etcd2:
+//	  name: {{.Name}}
+//	  discovery: {{.Discovery}}
+//	  advertise-client-urls: http://{{.PrivateIPv4}}:2379
+//
+// Text that looks like an action is written as an action producing it,
+// e.g. {{"{{"}}, and the quote function produces a double quoted and
+// escaped string suitable for YAML values.
+
+// UserData is the user data a machine is booted with.
+type UserData struct {
+	kind userDataKind
+	data string
+}
+
+type userDataKind int
+
+const (
+	kindCloudConfig userDataKind = iota
+	kindScript
+	kindOpaque
+)
+
+// CloudConfig returns user data holding a cloud-config template. The
+// SSH keys needed to reach the machine are added to it.
+func CloudConfig(tmpl string) *UserData {
+	return &UserData{kind: kindCloudConfig, data: tmpl}
+}
+
+// Script returns user data holding a template of a script, starting
+// with "#!", for coreos-cloudinit to run at boot. SSH keys are provided
+// through platform metadata.
+func Script(tmpl string) *UserData {
+	return &UserData{kind: kindScript, data: tmpl}
+}
+
+// Opaque returns user data that is passed to the machine exactly as
+// given, for provisioning formats mantle doesn't understand. SSH keys
+// are provided through platform metadata.
+func Opaque(data []byte) *UserData {
+	return &UserData{kind: kindOpaque, data: string(data)}
+}
+
+// Placeholders expanded by coreos-cloudinit on platforms where the
+// machine's addresses aren't known until it has booted.
+const (
+	cloudinitPrivateIPv4 = "$private_ipv4"
+	cloudinitPublicIPv4  = "$public_ipv4"
+)
+
+// MachineInfo describes a machine to user data templates.
+type MachineInfo struct {
+	Index       int    // order the machine was created in the cluster, from 0
+	Name        string // unique within the cluster, e.g. "instance0"
+	PrivateIPv4 string
+	PublicIPv4  string
+}
+
+// UserDataParams holds the values available to user data templates.
+type UserDataParams struct {
+	MachineInfo
+
+	Discovery   string // the last URL returned by Cluster.GetDiscoveryURL
+	ClusterSize int    // the size passed to Cluster.GetDiscoveryURL
+
+	// Peers lists the other machines that were already running in
+	// the cluster when this one was created, in creation order.
+	Peers []MachineInfo
+}
+
+var userDataFuncs = template.FuncMap{
+	"quote": strconv.Quote,
+}
+
+// RenderUserData expands the user data template tmpl with params.
+func RenderUserData(tmpl string, params UserDataParams) (string, error) {
+	t, err := template.New("userdata").Funcs(userDataFuncs).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("parsing user data template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, params); err != nil {
+		return "", fmt.Errorf("expanding user data template: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// userData keeps the cluster wide state needed to expand user data
+// templates. Each platform's cluster embeds one.
+type userData struct {
+	mu        sync.Mutex
+	discovery string
+	size      int
+	next      int
+	infos     map[string]MachineInfo // by machine ID
+}
+
+// setDiscovery records the result of a GetDiscoveryURL call.
+func (u *userData) setDiscovery(url string, size int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.discovery = url
+	u.size = size
+}
+
+// render expands ud for a new machine with the given addresses. A nil
+// ud is an empty cloud config. running are the cluster's current
+// machines. The returned MachineInfo must be passed to added once the
+// machine is running.
+func (u *userData) render(ud *UserData, privateIP, publicIP string, running []Machine) (string, MachineInfo, error) {
+	if ud == nil {
+		ud = CloudConfig("")
+	}
+
+	u.mu.Lock()
+	info := MachineInfo{
+		Index:       u.next,
+		Name:        fmt.Sprintf("instance%d", u.next),
+		PrivateIPv4: privateIP,
+		PublicIPv4:  publicIP,
+	}
+	u.next++
+
+	params := UserDataParams{
+		MachineInfo: info,
+		Discovery:   u.discovery,
+		ClusterSize: u.size,
+	}
+	for _, m := range running {
+		if peer, ok := u.infos[m.ID()]; ok {
+			params.Peers = append(params.Peers, peer)
+		}
+	}
+	u.mu.Unlock()
+
+	sort.Sort(byIndex(params.Peers))
+
+	switch ud.kind {
+	case kindOpaque:
+		return ud.data, info, nil
+	case kindScript:
+		if !strings.HasPrefix(ud.data, "#!") {
+			return "", info, fmt.Errorf("script user data must start with #!")
+		}
+	}
+
+	rendered, err := RenderUserData(ud.data, params)
+	return rendered, info, err
+}
+
+// added records that the machine with the given ID is running.
+func (u *userData) added(id string, info MachineInfo) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.infos == nil {
+		u.infos = make(map[string]MachineInfo)
+	}
+	u.infos[id] = info
+}
+
+// injectSSHKeys adds keys to rendered user data if its format can
+// carry them, reporting whether it did. If not, the platform must
+// provide the keys through its metadata. If hostname is set it is used
+// for cloud configs that don't set their own.
+func injectSSHKeys(ud *UserData, rendered string, keys []string, hostname string) (string, bool, error) {
+	if ud != nil && ud.kind != kindCloudConfig {
+		return rendered, false, nil
+	}
+
+	cc, err := config.NewCloudConfig(rendered)
+	if err != nil {
+		return "", false, err
+	}
+	cc.SSHAuthorizedKeys = append(cc.SSHAuthorizedKeys, keys...)
+	if cc.Hostname == "" {
+		cc.Hostname = hostname
+	}
+	return cc.String(), true, nil
+}
+
+// agentKeys returns the public keys held by agent in authorized_keys
+// format.
+func agentKeys(agent *network.SSHAgent) ([]string, error) {
+	keys, err := agent.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var authorized []string
+	for _, key := range keys {
+		authorized = append(authorized, key.String())
+	}
+	return authorized, nil
+}
+
+type byIndex []MachineInfo
+
+func (s byIndex) Len() int           { return len(s) }
+func (s byIndex) Less(i, j int) bool { return s[i].Index < s[j].Index }
+func (s byIndex) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
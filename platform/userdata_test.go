@@ -0,0 +1,144 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderUserData(t *testing.T) {
+	params := UserDataParams{
+		MachineInfo: MachineInfo{
+			Index:       1,
+			Name:        "instance1",
+			PrivateIPv4: "10.0.0.3",
+			PublicIPv4:  "192.0.2.3",
+		},
+		Discovery:   "http://10.0.0.1:2379/v2/keys/discovery/1",
+		ClusterSize: 3,
+		Peers: []MachineInfo{
+			{Index: 0, Name: "instance0", PrivateIPv4: "10.0.0.2"},
+		},
+	}
+
+	for _, tt := range []struct {
+		in  string
+		out string
+	}{
+		{"", ""},
+		{"#!/bin/sh\necho $HOME\n", "#!/bin/sh\necho $HOME\n"},
+		{"name: {{.Name}}", "name: instance1"},
+		{"{{.Index}}/{{.ClusterSize}}", "1/3"},
+		{"discovery: {{.Discovery}}", "discovery: http://10.0.0.1:2379/v2/keys/discovery/1"},
+		{"{{.PrivateIPv4}} {{.PublicIPv4}}", "10.0.0.3 192.0.2.3"},
+		{"{{range .Peers}}{{.Name}}=http://{{.PrivateIPv4}}:2380{{end}}", "instance0=http://10.0.0.2:2380"},
+		{`{{"{{.Name}}"}}`, "{{.Name}}"},
+		{"{{quote .Name}}", `"instance1"`},
+	} {
+		out, err := RenderUserData(tt.in, params)
+		if err != nil {
+			t.Errorf("RenderUserData(%q): %v", tt.in, err)
+		} else if out != tt.out {
+			t.Errorf("RenderUserData(%q) = %q, want %q", tt.in, out, tt.out)
+		}
+	}
+
+	for _, in := range []string{"{{.Name", "{{.Bogus}}"} {
+		if _, err := RenderUserData(in, params); err == nil {
+			t.Errorf("RenderUserData(%q): expected an error", in)
+		}
+	}
+}
+
+// idMachine is a Machine with nothing but an ID.
+type idMachine struct {
+	Machine
+	id string
+}
+
+func (m idMachine) ID() string {
+	return m.id
+}
+
+func TestUserDataPeers(t *testing.T) {
+	var u userData
+	u.setDiscovery("http://discovery", 2)
+
+	tmpl := CloudConfig("{{.Name}} {{.Discovery}} {{range .Peers}}{{.Name}}@{{.PrivateIPv4}} {{end}}")
+
+	out, info, err := u.render(tmpl, "10.0.0.2", "10.0.0.2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "instance0 http://discovery "; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+	u.added("m0", info)
+
+	// machines that have been destroyed are not peers
+	out, _, err = u.render(tmpl, "10.0.0.3", "10.0.0.3", []Machine{idMachine{id: "m0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "instance1 http://discovery instance0@10.0.0.2 "; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+
+	out, _, err = u.render(tmpl, "10.0.0.4", "10.0.0.4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "instance2 http://discovery "; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestUserDataKinds(t *testing.T) {
+	for _, tt := range []struct {
+		ud      *UserData
+		want    string // contained in the output
+		keys    bool   // whether the format carries SSH keys
+		wantErr bool
+	}{
+		{nil, "ssh_authorized_keys:\n- ssh-rsa AAAA\n", true, false},
+		{CloudConfig("#cloud-config\nhostname: {{.Name}}\n"), "hostname: instance0\n", true, false},
+		{Script("#!/bin/sh\necho {{.Name}}\n"), "#!/bin/sh\necho instance0\n", false, false},
+		{Script("echo {{.Name}}\n"), "", false, true},
+		{Opaque([]byte(`{"ignition": "{{.Name}}"}`)), `{"ignition": "{{.Name}}"}`, false, false},
+	} {
+		var u userData
+		out, _, err := u.render(tt.ud, "10.0.0.2", "10.0.0.2", nil)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%+v: expected an error", tt.ud)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", tt.ud, err)
+			continue
+		}
+
+		out, keys, err := injectSSHKeys(tt.ud, out, []string{"ssh-rsa AAAA"}, "")
+		if err != nil {
+			t.Errorf("%+v: %v", tt.ud, err)
+			continue
+		}
+		if !strings.Contains(out, tt.want) || keys != tt.keys {
+			t.Errorf("%+v: got %q, %v, want %q, %v", tt.ud, out, keys, tt.want, tt.keys)
+		}
+	}
+}
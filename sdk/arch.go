@@ -15,7 +15,9 @@
 package sdk
 
 import (
+	"fmt"
 	"runtime"
+	"strings"
 )
 
 func LocalArch() string {
@@ -38,3 +40,24 @@ func LocalArch() string {
 	}
 	return arch
 }
+
+// UnameArch returns the arch, as named by LocalArch, of a machine whose
+// hardware name as printed by uname -m is machine. Unlike LocalArch it
+// works for machines other than the local one, such as those reached
+// over SSH.
+func UnameArch(machine string) (string, error) {
+	switch machine = strings.TrimSpace(machine); machine {
+	case "i386", "i486", "i586", "i686":
+		return "x86", nil
+	case "x86_64":
+		return "amd64", nil
+	case "aarch64":
+		return "arm64", nil
+	case "ppc64":
+		return "ppc64", nil
+	}
+	if strings.HasPrefix(machine, "armv") {
+		return "arm", nil
+	}
+	return "", fmt.Errorf("no portage arch defined for %q", machine)
+}
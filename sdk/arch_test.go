@@ -0,0 +1,43 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sdk
+
+import (
+	"testing"
+)
+
+func TestUnameArch(t *testing.T) {
+	for _, tt := range []struct {
+		machine string
+		arch    string
+	}{
+		{"x86_64\n", "amd64"},
+		{"i686", "x86"},
+		{"aarch64", "arm64"},
+		{"armv7l", "arm"},
+		{"ppc64", "ppc64"},
+		{"ppc64le", ""},
+		{"", ""},
+	} {
+		arch, err := UnameArch(tt.machine)
+		if tt.arch == "" {
+			if err == nil {
+				t.Errorf("UnameArch(%q) = %q, expected an error", tt.machine, arch)
+			}
+		} else if err != nil || arch != tt.arch {
+			t.Errorf("UnameArch(%q) = %q, %v, want %q", tt.machine, arch, err, tt.arch)
+		}
+	}
+}